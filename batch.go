@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// imageInput is one image to render and where its output goes, relative to --directory.
+type imageInput struct {
+	path   string
+	output string
+	// err, if set, fails the input without rendering it
+	err error
+}
+
+var imageExtensions = []string{".png", ".jpg", ".jpeg"}
+
+func isImagePath(path string) bool {
+	return slices.Contains(imageExtensions, strings.ToLower(filepath.Ext(path)))
+}
+
+// outputName is the name of the PNG rendered from path.
+func outputName(path string) string {
+	return strings.Split(filepath.Base(path), ".")[0] + ".png"
+}
+
+// expandInputs turns the arguments into the images to render. Files and glob matches are written
+// under their own name, images found in a directory keep their path relative to it. Directories
+// are only searched below their top level when recursive is set.
+func expandInputs(args []string, recursive bool) ([]imageInput, error) {
+	var inputs []imageInput
+	for _, arg := range args {
+		paths := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+			paths = matches
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || !info.IsDir() {
+				// missing or unreadable files fail when they are loaded
+				inputs = append(inputs, imageInput{path: path, output: outputName(path)})
+				continue
+			}
+			found, err := findImages(path, recursive)
+			if err != nil {
+				return nil, err
+			}
+			inputs = append(inputs, found...)
+		}
+	}
+
+	// two inputs that would overwrite each other's output both fail
+	outputs := map[string]string{}
+	for i, input := range inputs {
+		if other, exists := outputs[input.output]; exists {
+			inputs[i].err = fmt.Errorf("output %s is already written for %s", input.output, other)
+			continue
+		}
+		outputs[input.output] = input.path
+	}
+	return inputs, nil
+}
+
+func findImages(dir string, recursive bool) ([]imageInput, error) {
+	var inputs []imageInput
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isImagePath(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, imageInput{path: path, output: filepath.Join(filepath.Dir(rel), outputName(rel))})
+		return nil
+	})
+	return inputs, err
+}
+
+// runBatch renders the inputs on jobs workers, reports each result as it comes in and prints
+// a summary at the end. It returns the number of failed inputs.
+func runBatch(ctx context.Context, inputs []imageInput, jobs int, render func(ctx context.Context, input imageInput) error) int {
+	errs := make([]error, len(inputs))
+	indices := make(chan int)
+	var mu sync.Mutex
+	done := 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < max(jobs, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				err := inputs[i].err
+				if err == nil {
+					err = ctx.Err()
+				}
+				if err == nil {
+					err = render(ctx, inputs[i])
+				}
+				errs[i] = err
+
+				mu.Lock()
+				done++
+				if err != nil {
+					fmt.Printf("[%d/%d] %s: %v\n", done, len(inputs), inputs[i].path, err)
+				} else {
+					fmt.Printf("[%d/%d] %s -> %s\n", done, len(inputs), inputs[i].path, inputs[i].output)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range inputs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	fmt.Printf("\n%d of %d images rendered, %d failed.\n", len(inputs)-failed, len(inputs), failed)
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("  %s: %v\n", inputs[i].path, err)
+		}
+	}
+	return failed
+}
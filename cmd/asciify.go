@@ -2,11 +2,12 @@ package cmd
 
 import (
 	"asciify/cmd/utils"
+	"context"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
-	"log"
+	"io"
 	"os"
 
 	"golang.org/x/image/font"
@@ -36,81 +37,227 @@ func drawCharacter(img *image.RGBA, pos image.Point, c rune, face font.Face, sca
 		Dst:  img,
 		Src:  image.NewUniform(colorSource),
 		Face: face,
-		Dot:  fixed.P(pos.X*scaleFactor, pos.Y*scaleFactor),
+		// sit the baseline on the bottom of the cell, leaving room for descenders
+		Dot: fixed.Point26_6{
+			X: fixed.I(pos.X * scaleFactor),
+			Y: fixed.I((pos.Y+1)*scaleFactor) - face.Metrics().Descent,
+		},
 	}
 	d.DrawString(string(c))
 }
 
-func AsciifyImage(sourceImage image.Image, outputPath, fontPath string, scaleFactor, bloomThreshold int, backgroundColor, baseColor color.Color, bloom, crt, monochrome, burn bool) {
-	width := sourceImage.Bounds().Dx()
-	height := sourceImage.Bounds().Dy()
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
-	_, _, downscaled := utils.DownscaleImage(sourceImage, scaleFactor)
+type BloomTarget string
 
-	palette := utils.GenerateSpicedBrightnessPalette(baseColor, 8)
-
-	// Generate edge map
-	_, angleMap := getSobelFilter(sourceImage)
-	edgeMap := optimizedShaderMap(angleMap, width, height, scaleFactor)
+const (
+	BloomSource BloomTarget = "source"
+	BloomGlyphs BloomTarget = "glyphs"
+)
 
-	var colorMap image.Image
-	if bloom {
-		colorMap = utils.BloomImage(downscaled, 2, float64(bloomThreshold), 5).(*image.RGBA)
-	} else {
-		colorMap = downscaled
+func ParseBloomTarget(s string) (BloomTarget, error) {
+	switch target := BloomTarget(s); target {
+	case BloomSource, BloomGlyphs:
+		return target, nil
+	case "":
+		return BloomSource, nil
 	}
+	return "", fmt.Errorf("unknown bloom target %q", s)
+}
+
+// Options configures a single asciify run.
+type Options struct {
+	FontPath        string
+	ScaleFactor     int
+	BackgroundColor color.Color
+	BaseColor       color.Color
+	Bloom           bool
+	CRT             bool
+	Monochrome      bool
+	Burn            bool
+	Mode            RenderMode
+	// Gradient, if set, replaces the base color palette of monochrome mode with a gradient map through these stops.
+	Gradient []color.Color
+	// Shades is the number of palette colors in monochrome mode, spread by Progression.
+	Shades      int
+	Progression utils.Progression
+	// BrailleSource picks what raises braille dots: the image luminance or its Sobel edge map.
+	BrailleSource    BrailleSource
+	BrailleThreshold float64
+	Dither           utils.DitherMethod
+	// Luminance is used for ramp selection, monochrome palette indexing, Sobel input and bloom thresholding.
+	Luminance utils.LuminanceModel
+	// Preprocess is the tone mapping applied to the source before anything else.
+	Preprocess utils.PreprocessOptions
+	// BloomOptions tunes the bloom effect, BloomTarget decides whether it lights up the
+	// source colors before glyphs are picked or the final rendered glyphs.
+	BloomOptions utils.BloomOptions
+	BloomTarget  BloomTarget
+	// AlphaMode decides what transparent source pixels become: empty cells, or the background
+	// color they are flattened onto. Cells whose alpha is below AlphaThreshold (0 to 1) are left empty.
+	AlphaMode      AlphaMode
+	AlphaThreshold float64
+	// Transparent starts the canvas fully transparent, so only glyphs (and cell backgrounds) are painted.
+	Transparent bool
+	// CellBackground fills each cell with a darkened, desaturated version of its color
+	// (or a darker palette shade in monochrome), instead of the plain canvas.
+	CellBackground           CellBackgroundMode
+	CellBackgroundDarken     float64
+	CellBackgroundDesaturate float64
+	// Palette, if set, snaps every cell color of full color mode to its closest entry,
+	// dithering foregrounds across the grid with PaletteDither.
+	Palette       []color.Color
+	PaletteDither utils.DitherMethod
+	// Composite blends the render over the source image instead of a solid canvas. The source can be
+	// blurred and darkened first so the glyphs stay readable.
+	Composite        bool
+	CompositeOpacity float64
+	CompositeBlend   utils.BlendMode
+	CompositeBlur    uint32
+	CompositeDarken  float64
+	// BurnMode is the blend mode the burn effect blends the rendered image onto itself with. Empty
+	// keeps the classic burn, which brightens every channel by 20%.
+	BurnMode utils.BlendMode
+	// BurnStrength is the opacity of the BurnMode blend. 0 means 0.5.
+	BurnStrength float64
+	// TileRows, if positive, makes AsciifyImageTiled process this many cell rows at a time.
+	TileRows int
+	// DebugDir, if set, receives intermediate images of the pipeline.
+	DebugDir string
+	// Terminal, if set, also receives the result as truecolor ANSI text.
+	Terminal io.Writer
+	// Metadata is written into the output PNG as text chunks, e.g. the settings of the render.
+	Metadata map[string]string
+	// Stages, if set, names the pipeline's stages in order instead of DefaultStages.
+	Stages []string
+	// Progress, if set, is told which stage the render is in and how far along it is.
+	Progress Progress
+}
 
-	// Set the background color for the output image
-	if monochrome {
-		draw.Draw(img, img.Bounds(), image.NewUniform(backgroundColor), image.Point{}, draw.Src)
-	} else {
-		draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+// AsciifyImage renders sourceImage with the pipeline for opts and saves it to outputPath. It stops
+// early with ctx's error once ctx is cancelled, and reports its progress to opts.Progress.
+func AsciifyImage(ctx context.Context, sourceImage image.Image, outputPath string, opts Options) error {
+	pipeline, err := NewPipeline(opts)
+	if err != nil {
+		return err
 	}
+	return pipeline.Render(ctx, sourceImage, outputPath)
+}
 
-	// Load the font
-	fontSize := float64(scaleFactor)
-	face, err := loadFont(fontPath, fontSize)
+// loadFace loads the glyph font at the size of one cell.
+func loadFace(opts Options) (font.Face, error) {
+	fontSize := float64(opts.ScaleFactor)
+	face, err := loadFont(opts.FontPath, fontSize)
 	if err != nil {
-		fmt.Println("Error loading font: ", err)
-		log.Fatal(err)
+		return nil, fmt.Errorf("error loading font: %w", err)
 	}
+	return face, nil
+}
 
-	// DEBUG SAVE IMAGE
-	// utils.SaveImage(downscaled, "downscaled.png")
-
-	// Iterate over each downscaled pixel and determine ASCII character based on edge directions
-	for y := downscaled.Bounds().Min.Y; y < downscaled.Bounds().Max.Y; y++ {
-		for x := downscaled.Bounds().Min.X; x < downscaled.Bounds().Max.X; x++ {
-			// Default character based on luminance
-			c := colorMap.At(x, y)
-			asciiChar := utils.GetLuminanceCharacter(c)
-			if edgeMap[y][x] != ' ' {
-				asciiChar = edgeMap[y][x]
-			}
+type AlphaMode string
 
-			// Determine character color
-			var charColor color.Color
-			if monochrome {
-				lum := utils.GetLuminance(c)
-				lum /= 65535.0
-				paletteIndex := uint(lum * float64(len(palette)-1))
-				charColor = palette[paletteIndex]
-			} else {
-				r, g, b, a := c.RGBA()
-				charColor = color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
-			}
+const (
+	AlphaEmpty AlphaMode = "empty"
+	AlphaMatte AlphaMode = "matte"
+)
+
+func ParseAlphaMode(s string) (AlphaMode, error) {
+	switch mode := AlphaMode(s); mode {
+	case AlphaEmpty, AlphaMatte:
+		return mode, nil
+	case "":
+		return AlphaEmpty, nil
+	}
+	return "", fmt.Errorf("unknown alpha mode %q", s)
+}
+
+// matteColor is the solid background of the output: black, or the background color in monochrome mode.
+func matteColor(opts Options) color.Color {
+	if opts.Monochrome {
+		return opts.BackgroundColor
+	}
+	return color.Black
+}
 
-			// Draw the ASCII character at the calculated position
-			drawCharacter(img, image.Pt(x, y), asciiChar, face, scaleFactor, charColor)
+// clearTransparentCells empties cells whose source alpha is below threshold.
+func clearTransparentCells(grid *CellGrid, threshold float64) {
+	limit := uint8(utils.Clamp(threshold, 0, 1) * 255)
+	for i := range grid.Cells {
+		cell := &grid.Cells[i]
+		if cell.Foreground.A > limit || (cell.HasBackground && cell.Background.A > limit) {
+			continue
 		}
+		*cell = Cell{Char: ' '}
 	}
+}
 
-	if burn {
-		img = utils.ApplyColorBurn(img, 1.2).(*image.RGBA)
+func bloomOptions(opts Options) utils.BloomOptions {
+	bloomOpts := opts.BloomOptions
+	bloomOpts.Luminance = opts.Luminance
+	if bloomOpts.DebugDir == "" {
+		bloomOpts.DebugDir = opts.DebugDir
 	}
-	if crt {
-		// do nothing yet
+	return bloomOpts
+}
+
+// compositeOverSource blends the rendered glyphs on top of a blurred and darkened copy of the source.
+// report is called with the share of the work done.
+func compositeOverSource(ctx context.Context, report func(fraction float64) error, img *image.RGBA, sourceImage image.Image, opts Options) (*image.RGBA, error) {
+	var background image.Image = sourceImage
+	if opts.CompositeBlur > 0 {
+		blurred, err := utils.StackBlur(ctx, sourceImage, opts.CompositeBlur)
+		if err != nil {
+			return nil, fmt.Errorf("blurring composite background: %w", err)
+		}
+		background = blurred
+		if err := report(0.5); err != nil {
+			return nil, err
+		}
+	}
+
+	// move the background into the render's coordinate space
+	canvas := image.NewRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), background, background.Bounds().Min, draw.Src)
+
+	if opts.CompositeDarken > 0 {
+		shade := uint8(utils.Clamp(1-opts.CompositeDarken, 0, 1) * 255)
+		var err error
+		if canvas, err = utils.BlendImagesContext(ctx, canvas, image.NewUniform(color.Gray{Y: shade}), utils.BlendMultiply, 1); err != nil {
+			return nil, err
+		}
+		if err := report(0.75); err != nil {
+			return nil, err
+		}
 	}
-	// Save the final image with edge effects
-	utils.SaveImage(img, outputPath)
+
+	mode := opts.CompositeBlend
+	if mode == "" {
+		mode = utils.BlendScreen
+	}
+	return utils.BlendImagesContext(ctx, canvas, img, mode, opts.CompositeOpacity)
+}
+
+// renderCellGrid rasterizes the grid onto a canvas of scaleFactor-sized cells.
+// report is called with the share of rows done.
+func renderCellGrid(report func(fraction float64) error, grid *CellGrid, atlas *glyphAtlas, scaleFactor int, canvas color.Color) (*image.RGBA, error) {
+	img := image.NewRGBA(image.Rect(0, 0, grid.Width*scaleFactor, grid.Height*scaleFactor))
+	draw.Draw(img, img.Bounds(), image.NewUniform(canvas), image.Point{}, draw.Src)
+
+	for y := 0; y < grid.Height; y++ {
+		if err := report(float64(y) / float64(grid.Height)); err != nil {
+			return nil, err
+		}
+		for x := 0; x < grid.Width; x++ {
+			cell := grid.At(x, y)
+			cellRect := image.Rect(x*scaleFactor, y*scaleFactor, (x+1)*scaleFactor, (y+1)*scaleFactor)
+
+			if cell.HasBackground {
+				draw.Draw(img, cellRect, image.NewUniform(cell.Background), image.Point{}, draw.Over)
+			}
+			if cell.Char == ' ' {
+				continue
+			}
+			atlas.draw(img, cellRect.Min, cell.Char, scaleFactor, cell.Foreground)
+		}
+	}
+
+	return img, nil
 }
@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"asciify/cmd/internal/testimage"
+	"asciify/cmd/utils"
+	"context"
+	"image"
+	"testing"
+)
+
+func BenchmarkSobel(b *testing.B) {
+	testimage.Benchmark(b, func(img *image.RGBA) { getSobelFilter(context.Background(), img, utils.LuminanceRec709) })
+}
+
+func BenchmarkDifferenceOfGaussians(b *testing.B) {
+	testimage.Benchmark(b, func(img *image.RGBA) { DifferenceOfGaussians(img, 1, 1.6, 0.3, 0.95) })
+}
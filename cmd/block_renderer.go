@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"asciify/cmd/utils"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+type RenderMode string
+
+const (
+	ModeASCII     RenderMode = "ascii"
+	ModeHalfBlock RenderMode = "halfblock"
+	ModeQuadrant  RenderMode = "quadrant"
+	ModeSextant   RenderMode = "sextant"
+)
+
+func ParseRenderMode(s string) (RenderMode, error) {
+	switch mode := RenderMode(s); mode {
+	case ModeASCII, ModeHalfBlock, ModeQuadrant, ModeSextant, ModeBraille:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown render mode %q", s)
+}
+
+// isASCII reports whether m draws one ASCII character per source cell, which is also what an empty mode does.
+func (m RenderMode) isASCII() bool {
+	return m != ModeHalfBlock && m != ModeQuadrant && m != ModeSextant && m != ModeBraille
+}
+
+// subPixels returns how many "pixels" a single cell of the given mode can represent.
+func (m RenderMode) subPixels() (cols, rows int) {
+	switch m {
+	case ModeHalfBlock:
+		return 1, 2
+	case ModeQuadrant:
+		return 2, 2
+	case ModeSextant:
+		return 2, 3
+	case ModeBraille:
+		return 2, 4
+	}
+	return 1, 1
+}
+
+// Quadrant characters indexed by a row-major bitmask: 1 = top left, 2 = top right, 4 = bottom left, 8 = bottom right.
+var quadrantRunes = [16]rune{' ', '▘', '▝', '▀', '▖', '▌', '▞', '▛', '▗', '▚', '▐', '▜', '▄', '▙', '▟', '█'}
+
+// sextantRune maps a row-major 2x3 bitmask to the Unicode 13 "Symbols for Legacy Computing" sextants.
+// The block skips the patterns that already exist as empty, full, left half and right half blocks.
+func sextantRune(mask uint8) rune {
+	switch mask {
+	case 0:
+		return ' '
+	case 21:
+		return '▌'
+	case 42:
+		return '▐'
+	case 63:
+		return '█'
+	}
+
+	index := rune(mask) - 1
+	if mask > 21 {
+		index--
+	}
+	if mask > 42 {
+		index--
+	}
+	return 0x1FB00 + index
+}
+
+type blockLayout struct {
+	cols, rows int
+	mask       uint8
+}
+
+// blockLayouts lets the PNG renderer rasterize block elements as rectangles,
+// since the bundled pixel fonts don't ship glyphs for them.
+var blockLayouts = func() map[rune]blockLayout {
+	layouts := map[rune]blockLayout{}
+	for mask, r := range quadrantRunes {
+		layouts[r] = blockLayout{2, 2, uint8(mask)}
+	}
+	for mask := uint8(1); mask < 63; mask++ {
+		r := sextantRune(mask)
+		if _, exists := layouts[r]; !exists {
+			layouts[r] = blockLayout{2, 3, mask}
+		}
+	}
+	return layouts
+}()
+
+// drawBlockCharacter fills the sub-rectangles of a block element inside cellRect.
+// Returns false if the rune is not a block element.
+func drawBlockCharacter(img *image.RGBA, cellRect image.Rectangle, c rune, fg color.Color) bool {
+	layout, ok := blockLayouts[c]
+	if !ok {
+		return false
+	}
+
+	w, h := cellRect.Dx(), cellRect.Dy()
+	src := image.NewUniform(fg)
+	for row := 0; row < layout.rows; row++ {
+		for col := 0; col < layout.cols; col++ {
+			if layout.mask&(1<<(row*layout.cols+col)) == 0 {
+				continue
+			}
+			subRect := image.Rect(
+				cellRect.Min.X+col*w/layout.cols,
+				cellRect.Min.Y+row*h/layout.rows,
+				cellRect.Min.X+(col+1)*w/layout.cols,
+				cellRect.Min.Y+(row+1)*h/layout.rows,
+			)
+			draw.Draw(img, subRect, src, image.Point{}, draw.Over)
+		}
+	}
+	return true
+}
+
+// splitColors partitions a cell's sub-pixels into a foreground and background group by
+// thresholding at the mean luminance, and returns the group bitmask and average colors.
+func splitColors(pixels []color.Color, lum utils.LuminanceModel) (uint8, color.RGBA, color.RGBA) {
+	var mean float64
+	lums := make([]float64, len(pixels))
+	for i, p := range pixels {
+		lums[i] = lum.Luminance(p)
+		mean += lums[i]
+	}
+	mean /= float64(len(pixels))
+
+	var mask uint8
+	var fgSum, bgSum [4]float64
+	fgCount, bgCount := 0, 0
+	for i, p := range pixels {
+		r, g, b, a := p.RGBA()
+		if lums[i] > mean {
+			mask |= 1 << i
+			fgSum[0], fgSum[1], fgSum[2], fgSum[3] = fgSum[0]+float64(r>>8), fgSum[1]+float64(g>>8), fgSum[2]+float64(b>>8), fgSum[3]+float64(a>>8)
+			fgCount++
+		} else {
+			bgSum[0], bgSum[1], bgSum[2], bgSum[3] = bgSum[0]+float64(r>>8), bgSum[1]+float64(g>>8), bgSum[2]+float64(b>>8), bgSum[3]+float64(a>>8)
+			bgCount++
+		}
+	}
+
+	// averaging premultiplied channels keeps transparency intact
+	average := func(sum [4]float64, count int) color.RGBA {
+		if count == 0 {
+			return color.RGBA{0, 0, 0, 255}
+		}
+		n := float64(count)
+		return color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+	}
+
+	return mask, average(fgSum, fgCount), average(bgSum, bgCount)
+}
+
+// buildBlockGrid converts an image whose size is (cols*subCols) x (rows*subRows) to a grid of block elements.
+func buildBlockGrid(colorMap image.Image, mode RenderMode, lum utils.LuminanceModel) *CellGrid {
+	subCols, subRows := mode.subPixels()
+	bounds := colorMap.Bounds()
+	grid := NewCellGrid(bounds.Dx()/subCols, bounds.Dy()/subRows)
+
+	pixels := make([]color.Color, subCols*subRows)
+	for y := 0; y < grid.Height; y++ {
+		for x := 0; x < grid.Width; x++ {
+			for row := 0; row < subRows; row++ {
+				for col := 0; col < subCols; col++ {
+					pixels[row*subCols+col] = colorMap.At(bounds.Min.X+x*subCols+col, bounds.Min.Y+y*subRows+row)
+				}
+			}
+
+			cell := grid.At(x, y)
+			cell.HasBackground = true
+
+			if mode == ModeHalfBlock {
+				// two sub-pixels fit exactly into foreground and background
+				cell.Char = '▀'
+				cell.Foreground = color.RGBAModel.Convert(pixels[0]).(color.RGBA)
+				cell.Background = color.RGBAModel.Convert(pixels[1]).(color.RGBA)
+				continue
+			}
+
+			mask, fg, bg := splitColors(pixels, lum)
+			if mode == ModeQuadrant {
+				cell.Char = quadrantRunes[mask]
+			} else {
+				cell.Char = sextantRune(mask)
+			}
+			cell.Foreground = fg
+			cell.Background = bg
+		}
+	}
+
+	return grid
+}
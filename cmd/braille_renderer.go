@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"asciify/cmd/utils"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+const ModeBraille RenderMode = "braille"
+
+type BrailleSource string
+
+const (
+	BrailleLuminance BrailleSource = "luminance"
+	BrailleEdges     BrailleSource = "edges"
+)
+
+func ParseBrailleSource(s string) (BrailleSource, error) {
+	switch source := BrailleSource(s); source {
+	case BrailleLuminance, BrailleEdges:
+		return source, nil
+	}
+	return "", fmt.Errorf("unknown braille source %q", s)
+}
+
+// brailleDots maps a (col, row) position inside the 2x4 braille cell to its dot bit.
+// Dots 7 and 8 were added later to the standard, hence the odd ordering of the bottom row.
+var brailleDots = [4][2]rune{
+	{0x01, 0x08},
+	{0x02, 0x10},
+	{0x04, 0x20},
+	{0x40, 0x80},
+}
+
+// buildBrailleGrid turns each 2x4 block of pixels into a braille character. intensity holds
+// the value that decides whether a dot is raised, colorMap provides the dot colors; both
+// are expected to be (cols*2) x (rows*4) pixels.
+func buildBrailleGrid(intensity, colorMap image.Image, threshold float64, dither utils.DitherMethod, lum utils.LuminanceModel) *CellGrid {
+	bounds := intensity.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	values := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			values[y*width+x] = lum.Luminance(intensity.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	dots := utils.Quantize(values, width, height, 2, threshold, dither)
+
+	colorBounds := colorMap.Bounds()
+	grid := NewCellGrid(width/2, height/4)
+	for y := 0; y < grid.Height; y++ {
+		for x := 0; x < grid.Width; x++ {
+			var pattern rune
+			var sum, raisedSum [4]float64
+			raised := 0
+
+			for row := 0; row < 4; row++ {
+				for col := 0; col < 2; col++ {
+					px, py := x*2+col, y*4+row
+					r, g, b, a := colorMap.At(colorBounds.Min.X+px, colorBounds.Min.Y+py).RGBA()
+					sum[0], sum[1], sum[2], sum[3] = sum[0]+float64(r>>8), sum[1]+float64(g>>8), sum[2]+float64(b>>8), sum[3]+float64(a>>8)
+					if dots[py*width+px] == 0 {
+						continue
+					}
+					pattern |= brailleDots[row][col]
+					raisedSum[0], raisedSum[1], raisedSum[2], raisedSum[3] = raisedSum[0]+float64(r>>8), raisedSum[1]+float64(g>>8), raisedSum[2]+float64(b>>8), raisedSum[3]+float64(a>>8)
+					raised++
+				}
+			}
+
+			cell := grid.At(x, y)
+			if raised == 0 {
+				// keep the cell's average color around for per-cell backgrounds
+				cell.Char = ' '
+				cell.Foreground = color.RGBA{uint8(sum[0] / 8), uint8(sum[1] / 8), uint8(sum[2] / 8), uint8(sum[3] / 8)}
+				continue
+			}
+			n := float64(raised)
+			cell.Char = 0x2800 + pattern
+			cell.Foreground = color.RGBA{uint8(raisedSum[0] / n), uint8(raisedSum[1] / n), uint8(raisedSum[2] / n), uint8(raisedSum[3] / n)}
+		}
+	}
+
+	return grid
+}
+
+// drawBrailleCharacter rasterizes the dots of a braille pattern as filled circles inside cellRect.
+// Returns false if the rune is not in the braille block.
+func drawBrailleCharacter(img *image.RGBA, cellRect image.Rectangle, c rune, fg color.Color) bool {
+	if c < 0x2800 || c > 0x28FF {
+		return false
+	}
+
+	pattern := c - 0x2800
+	dotW := float64(cellRect.Dx()) / 2
+	dotH := float64(cellRect.Dy()) / 4
+	radius := min(dotW, dotH) * 0.4
+	if radius < 0.5 {
+		radius = 0.5
+	}
+
+	for row := 0; row < 4; row++ {
+		for col := 0; col < 2; col++ {
+			if pattern&brailleDots[row][col] == 0 {
+				continue
+			}
+			cx := float64(cellRect.Min.X) + (float64(col)+0.5)*dotW
+			cy := float64(cellRect.Min.Y) + (float64(row)+0.5)*dotH
+
+			for py := int(cy - radius); py <= int(cy+radius); py++ {
+				for px := int(cx - radius); px <= int(cx+radius); px++ {
+					dx, dy := float64(px)+0.5-cx, float64(py)+0.5-cy
+					if dx*dx+dy*dy <= radius*radius {
+						img.Set(px, py, blendOver(img.At(px, py), fg))
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+// blendOver composites the premultiplied color src over dst.
+func blendOver(dst, src color.Color) color.RGBA {
+	dr, dg, db, da := dst.RGBA()
+	sr, sg, sb, sa := src.RGBA()
+	inv := 0xffff - sa
+	return color.RGBA{
+		uint8((sr + dr*inv/0xffff) >> 8),
+		uint8((sg + dg*inv/0xffff) >> 8),
+		uint8((sb + db*inv/0xffff) >> 8),
+		uint8((sa + da*inv/0xffff) >> 8),
+	}
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"asciify/cmd/utils"
+	"fmt"
+	"image/color"
+)
+
+type CellBackgroundMode string
+
+const (
+	CellBackgroundNone    CellBackgroundMode = "none"
+	CellBackgroundDarken  CellBackgroundMode = "darken"
+	CellBackgroundPalette CellBackgroundMode = "palette"
+)
+
+func ParseCellBackgroundMode(s string) (CellBackgroundMode, error) {
+	switch mode := CellBackgroundMode(s); mode {
+	case CellBackgroundNone, CellBackgroundDarken, CellBackgroundPalette:
+		return mode, nil
+	case "":
+		return CellBackgroundNone, nil
+	}
+	return "", fmt.Errorf("unknown cell background mode %q", s)
+}
+
+// applyCellBackgrounds gives every cell that doesn't have a background yet one derived
+// from its foreground, so sparse glyphs still carry the color of the image.
+func applyCellBackgrounds(grid *CellGrid, opts Options, palette []color.Color) {
+	if opts.CellBackground == CellBackgroundNone || opts.CellBackground == "" {
+		return
+	}
+
+	for i := range grid.Cells {
+		cell := &grid.Cells[i]
+		// transparent cells stay empty
+		if cell.HasBackground || cell.Foreground.A == 0 {
+			continue
+		}
+		cell.Background = cellBackground(cell.Foreground, opts, palette)
+		cell.HasBackground = true
+	}
+}
+
+// cellBackground derives a background from a foreground color. Palette mode picks a darker shade
+// of the monochrome palette; otherwise (or if fg isn't a palette color) the color is darkened and desaturated.
+func cellBackground(fg color.RGBA, opts Options, palette []color.Color) color.RGBA {
+	if opts.CellBackground == CellBackgroundPalette && opts.Monochrome {
+		for i, shade := range palette {
+			if utils.WithAlpha(shade, fg.A) == fg {
+				index := int(float64(i) * utils.Clamp(opts.CellBackgroundDarken, 0, 1))
+				return utils.WithAlpha(palette[index], fg.A)
+			}
+		}
+	}
+
+	h, s, v := utils.RGBToHSV(fg.R, fg.G, fg.B)
+	s *= 1 - utils.Clamp(opts.CellBackgroundDesaturate, 0, 1)
+	v *= utils.Clamp(opts.CellBackgroundDarken, 0, 1)
+	r, g, b := utils.HSVToRGB(h, s, v)
+	// fg is premultiplied, so the darkened channels stay below its alpha
+	return color.RGBA{r, g, b, fg.A}
+}
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// Cell is a single character cell of the output: the glyph to draw, its color,
+// and optionally a background fill that replaces the canvas color for this cell.
+type Cell struct {
+	Char          rune
+	Foreground    color.RGBA
+	Background    color.RGBA
+	HasBackground bool
+}
+
+// CellGrid is the renderer-independent result of asciifying an image. The PNG rasterizer
+// and the text, terminal, HTML and SVG writers all consume it.
+type CellGrid struct {
+	Width, Height int
+	Cells         []Cell
+}
+
+func NewCellGrid(width, height int) *CellGrid {
+	return &CellGrid{
+		Width:  width,
+		Height: height,
+		Cells:  make([]Cell, width*height),
+	}
+}
+
+func (g *CellGrid) At(x, y int) *Cell {
+	return &g.Cells[y*g.Width+x]
+}
+
+// Rows returns the rows [y0, y1) of the grid. The cells are shared, not copied.
+func (g *CellGrid) Rows(y0, y1 int) *CellGrid {
+	return &CellGrid{
+		Width:  g.Width,
+		Height: y1 - y0,
+		Cells:  g.Cells[y0*g.Width : y1*g.Width],
+	}
+}
+
+// WriteANSI prints the grid to a truecolor terminal using 24-bit SGR escape codes.
+// Escape codes are only emitted when the color changes from the previous cell.
+func WriteANSI(w io.Writer, grid *CellGrid) error {
+	out := bufio.NewWriter(w)
+
+	for y := 0; y < grid.Height; y++ {
+		var lastFg, lastBg color.RGBA
+		hasFg, hasBg := false, false
+
+		for x := 0; x < grid.Width; x++ {
+			cell := grid.At(x, y)
+
+			if cell.HasBackground {
+				if !hasBg || cell.Background != lastBg {
+					fmt.Fprintf(out, "\x1b[48;2;%d;%d;%dm", cell.Background.R, cell.Background.G, cell.Background.B)
+					lastBg, hasBg = cell.Background, true
+				}
+			} else if hasBg {
+				// drop back to the terminal's own background
+				out.WriteString("\x1b[49m")
+				hasBg = false
+			}
+
+			if cell.Char != ' ' && (!hasFg || cell.Foreground != lastFg) {
+				fmt.Fprintf(out, "\x1b[38;2;%d;%d;%dm", cell.Foreground.R, cell.Foreground.G, cell.Foreground.B)
+				lastFg, hasFg = cell.Foreground, true
+			}
+			out.WriteRune(cell.Char)
+		}
+		out.WriteString("\x1b[0m\n")
+	}
+
+	return out.Flush()
+}
+
+// WriteText writes the grid's characters without any color, one line per row.
+func WriteText(w io.Writer, grid *CellGrid) error {
+	out := bufio.NewWriter(w)
+	for y := 0; y < grid.Height; y++ {
+		for x := 0; x < grid.Width; x++ {
+			out.WriteRune(grid.At(x, y).Char)
+		}
+		out.WriteByte('\n')
+	}
+	return out.Flush()
+}
+
+// cssColor formats c for HTML and SVG, which expect colors that aren't alpha-premultiplied.
+func cssColor(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if n.A == 0xff {
+		return fmt.Sprintf("#%02x%02x%02x", n.R, n.G, n.B)
+	}
+	return fmt.Sprintf("rgba(%d,%d,%d,%.3g)", n.R, n.G, n.B, float64(n.A)/0xff)
+}
+
+// WriteHTML writes the grid as a <pre> block on the background color, with one span per run of
+// cells that share their colors. Blank cells without a background join the run they are in.
+func WriteHTML(w io.Writer, grid *CellGrid, background color.Color) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "<pre style=\"background:%s;line-height:1\">", cssColor(background))
+
+	for y := 0; y < grid.Height; y++ {
+		style, open := "", false
+		for x := 0; x < grid.Width; x++ {
+			cell := grid.At(x, y)
+			if cell.Char != ' ' || cell.HasBackground || !open {
+				cellStyle := "color:" + cssColor(cell.Foreground)
+				if cell.HasBackground {
+					cellStyle += ";background:" + cssColor(cell.Background)
+				}
+				if !open || cellStyle != style {
+					if open {
+						out.WriteString("</span>")
+					}
+					fmt.Fprintf(out, "<span style=\"%s\">", cellStyle)
+					style, open = cellStyle, true
+				}
+			}
+			out.WriteString(html.EscapeString(string(cell.Char)))
+		}
+		if open {
+			out.WriteString("</span>")
+		}
+		out.WriteByte('\n')
+	}
+
+	out.WriteString("</pre>\n")
+	return out.Flush()
+}
+
+// WriteSVG writes the grid as an SVG image of square cells cellSize pixels wide: the background,
+// a rect per run of equal cell backgrounds and a text element per run of equally colored glyphs.
+// Every glyph is placed in its own cell, but drawn in the viewer's monospace font rather than
+// the font of the PNG.
+func WriteSVG(w io.Writer, grid *CellGrid, cellSize int, background color.Color) error {
+	out := bufio.NewWriter(w)
+	width, height := grid.Width*cellSize, grid.Height*cellSize
+	fmt.Fprintf(out, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" font-family=\"monospace\" font-size=\"%d\" text-anchor=\"middle\">\n",
+		width, height, width, height, cellSize)
+	if _, _, _, a := background.RGBA(); a > 0 {
+		fmt.Fprintf(out, "<rect width=\"100%%\" height=\"100%%\" fill=\"%s\"/>\n", cssColor(background))
+	}
+
+	for y := 0; y < grid.Height; y++ {
+		top := y * cellSize
+		for x := 0; x < grid.Width; {
+			cell := grid.At(x, y)
+			if !cell.HasBackground {
+				x++
+				continue
+			}
+			end := x + 1
+			for end < grid.Width && grid.At(end, y).HasBackground && grid.At(end, y).Background == cell.Background {
+				end++
+			}
+			fmt.Fprintf(out, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n",
+				x*cellSize, top, (end-x)*cellSize, cellSize, cssColor(cell.Background))
+			x = end
+		}
+	}
+
+	// glyphs sit on a baseline a fifth of the cell above its bottom, centered horizontally
+	for y := 0; y < grid.Height; y++ {
+		baseline := y*cellSize + cellSize*4/5
+		for x := 0; x < grid.Width; {
+			cell := grid.At(x, y)
+			if cell.Char == ' ' {
+				x++
+				continue
+			}
+			var xs []string
+			var text strings.Builder
+			end := x
+			for ; end < grid.Width; end++ {
+				next := grid.At(end, y)
+				if next.Char == ' ' || next.Foreground != cell.Foreground {
+					break
+				}
+				xs = append(xs, fmt.Sprint(end*cellSize+cellSize/2))
+				text.WriteString(html.EscapeString(string(next.Char)))
+			}
+			fmt.Fprintf(out, "<text x=\"%s\" y=\"%d\" fill=\"%s\">%s</text>\n",
+				strings.Join(xs, " "), baseline, cssColor(cell.Foreground), text.String())
+			x = end
+		}
+	}
+
+	out.WriteString("</svg>\n")
+	return out.Flush()
+}
@@ -3,8 +3,6 @@ package cmd
 import (
 	"asciify/cmd/utils"
 	"image"
-	"image/color"
-	"sort"
 )
 
 func DifferenceOfGaussians(src image.Image, sigma, sigma_scale, threshold, tau float64) *image.Gray {
@@ -15,19 +13,24 @@ func DifferenceOfGaussians(src image.Image, sigma, sigma_scale, threshold, tau f
 	height := src.Bounds().Dy()
 	dogImage := image.NewGray(src.Bounds())
 
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			lum1 := utils.GetLuminance(blur1.At(x, y)) / 65535.0 * 255
-			lum2 := utils.GetLuminance(blur2.At(x, y)) / 65535.0 * 255
-			difference := (1+tau)*lum1 - tau*lum2
+	luminance := func(pix []uint8) float64 {
+		return 0.2126*float64(pix[0]) + 0.7152*float64(pix[1]) + 0.0722*float64(pix[2])
+	}
+
+	utils.ParallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				i := y*blur1.Stride + x*4
+				lum1 := luminance(blur1.Pix[i : i+3])
+				lum2 := luminance(blur2.Pix[i : i+3])
+				difference := (1+tau)*lum1 - tau*lum2
 
-			if difference > threshold*255.0 {
-				dogImage.SetGray(x, y, color.Gray{Y: 255})
-			} else {
-				dogImage.SetGray(x, y, color.Gray{Y: 0})
+				if difference > threshold*255.0 {
+					dogImage.Pix[y*dogImage.Stride+x] = 255
+				}
 			}
 		}
-	}
+	})
 
 	// Optional: Apply smoothing to reduce isolated noise
 	return medianFilter(dogImage)
@@ -39,28 +42,34 @@ func medianFilter(img *image.Gray) *image.Gray {
 	height := img.Bounds().Dy()
 	filtered := image.NewGray(img.Bounds())
 
-	for y := 1; y < height-1; y++ {
-		for x := 1; x < width-1; x++ {
-			// Collect values from the 3x3 neighborhood
-			var pixels []uint8
-			for ky := -1; ky <= 1; ky++ {
-				for kx := -1; kx <= 1; kx++ {
-					pixels = append(pixels, img.GrayAt(x+kx, y+ky).Y)
+	utils.ParallelRows(height, func(y0, y1 int) {
+		var pixels [9]uint8
+		for y := max(y0, 1); y < min(y1, height-1); y++ {
+			for x := 1; x < width-1; x++ {
+				// Collect values from the 3x3 neighborhood
+				n := 0
+				for ky := -1; ky <= 1; ky++ {
+					row := img.Pix[(y+ky)*img.Stride:]
+					for kx := -1; kx <= 1; kx++ {
+						pixels[n] = row[x+kx]
+						n++
+					}
 				}
+				// Find median value in the 3x3 neighborhood
+				filtered.Pix[y*filtered.Stride+x] = findMedian(&pixels)
 			}
-			// Find median value in the 3x3 neighborhood
-			median := findMedian(pixels)
-			filtered.SetGray(x, y, color.Gray{Y: median})
 		}
-	}
+	})
 
 	return filtered
 }
 
-// Find median value in a slice of uint8 values
-func findMedian(pixels []uint8) uint8 {
-	sort.Slice(pixels, func(i, j int) bool {
-		return pixels[i] < pixels[j]
-	})
+// Find median value of a 3x3 neighborhood, sorting it in place
+func findMedian(pixels *[9]uint8) uint8 {
+	for i := 1; i < len(pixels); i++ {
+		for j := i; j > 0 && pixels[j] < pixels[j-1]; j-- {
+			pixels[j], pixels[j-1] = pixels[j-1], pixels[j]
+		}
+	}
 	return pixels[len(pixels)/2]
 }
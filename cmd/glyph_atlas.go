@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"image"
+	"image/color"
+	"sync"
+
+	"golang.org/x/image/font"
+)
+
+type glyphKey struct {
+	char rune
+	size int
+}
+
+// glyphAtlas caches the coverage mask of every rune it has drawn, so each glyph is rasterized
+// once per size instead of once per cell. Masks are positioned relative to the cell's top left
+// corner and may extend past the cell, like descenders do. It is safe for concurrent use.
+type glyphAtlas struct {
+	face  font.Face
+	mu    sync.Mutex
+	masks map[glyphKey]*image.Alpha
+}
+
+func newGlyphAtlas(face font.Face) *glyphAtlas {
+	return &glyphAtlas{face: face, masks: map[glyphKey]*image.Alpha{}}
+}
+
+func (a *glyphAtlas) mask(c rune, size int) *image.Alpha {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := glyphKey{c, size}
+	if mask, ok := a.masks[key]; ok {
+		return mask
+	}
+	mask := a.rasterize(c, size)
+	a.masks[key] = mask
+	return mask
+}
+
+// rasterize draws the rune in opaque white into the middle of a 3x3 cell scratch canvas and
+// keeps the alpha of the part that was painted.
+func (a *glyphAtlas) rasterize(c rune, size int) *image.Alpha {
+	scratch := image.NewRGBA(image.Rect(0, 0, 3*size, 3*size))
+	cellRect := image.Rect(size, size, 2*size, 2*size)
+	if !drawBlockCharacter(scratch, cellRect, c, color.White) && !drawBrailleCharacter(scratch, cellRect, c, color.White) {
+		drawCharacter(scratch, image.Pt(1, 1), c, a.face, size, color.White)
+	}
+
+	var painted image.Rectangle
+	for y := 0; y < 3*size; y++ {
+		for x := 0; x < 3*size; x++ {
+			if scratch.Pix[scratch.PixOffset(x, y)+3] != 0 {
+				painted = painted.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	mask := image.NewAlpha(painted.Sub(cellRect.Min))
+	for y := painted.Min.Y; y < painted.Max.Y; y++ {
+		for x := painted.Min.X; x < painted.Max.X; x++ {
+			mask.Pix[mask.PixOffset(x-size, y-size)] = scratch.Pix[scratch.PixOffset(x, y)+3]
+		}
+	}
+	return mask
+}
+
+// draw composites the rune's mask in the premultiplied color fg over the cell at cellMin.
+func (a *glyphAtlas) draw(img *image.RGBA, cellMin image.Point, c rune, size int, fg color.RGBA) {
+	mask := a.mask(c, size)
+	area := mask.Rect.Add(cellMin).Intersect(img.Rect)
+	if area.Empty() || fg.A == 0 {
+		return
+	}
+
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		maskRow := mask.Pix[mask.PixOffset(area.Min.X-cellMin.X, y-cellMin.Y):]
+		dst := img.Pix[img.PixOffset(area.Min.X, y):]
+		for x := 0; x < area.Dx(); x++ {
+			m := uint32(maskRow[x])
+			if m == 0 {
+				continue
+			}
+			p := dst[x*4 : x*4+4 : x*4+4]
+			inv := 255 - uint32(fg.A)*m/255
+			p[0] = uint8((uint32(fg.R)*m + uint32(p[0])*inv) / 255)
+			p[1] = uint8((uint32(fg.G)*m + uint32(p[1])*inv) / 255)
+			p[2] = uint8((uint32(fg.B)*m + uint32(p[2])*inv) / 255)
+			p[3] = uint8((uint32(fg.A)*m + uint32(p[3])*inv) / 255)
+		}
+	}
+}
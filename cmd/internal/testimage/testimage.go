@@ -0,0 +1,68 @@
+// Package testimage builds the deterministic images the tests and benchmarks of asciify run on.
+package testimage
+
+import (
+	"image"
+	"testing"
+)
+
+// Sizes are the image sizes quoted in the README. Run the benchmarks with
+//
+//	go test -run '^$' -bench . -benchtime 3x ./cmd/...
+var Sizes = []struct {
+	Name          string
+	Width, Height int
+}{
+	{"6K", 6144, 3160},
+	{"2K", 2048, 1080},
+	{"1080p", 1920, 1280},
+}
+
+// Card is an opaque test card: smooth gradients with a grid of hard edges every 64 pixels.
+func Card(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			edge := uint8(0)
+			if (x/64+y/64)%2 == 0 {
+				edge = 96
+			}
+			img.Pix[i] = uint8(x*255/width)/2 + edge
+			img.Pix[i+1] = uint8(y*255/height)/2 + edge
+			img.Pix[i+2] = uint8((x+y)*255/(width+height))/2 + edge
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
+
+// TranslucentCard is Card with its alpha cycling through 0, 64, 128, 192 and 255, premultiplied,
+// so every run of five pixels has a fully transparent and a fully opaque one.
+func TranslucentCard(width, height int) *image.RGBA {
+	img := Card(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			a := uint32(min((x+2*y)%5*64, 255))
+			for c := 0; c < 3; c++ {
+				img.Pix[i+c] = uint8(uint32(img.Pix[i+c]) * a / 255)
+			}
+			img.Pix[i+3] = uint8(a)
+		}
+	}
+	return img
+}
+
+// Benchmark runs run on a Card of every size in Sizes.
+func Benchmark(b *testing.B, run func(img *image.RGBA)) {
+	for _, size := range Sizes {
+		img := Card(size.Width, size.Height)
+		b.Run(size.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				run(img)
+			}
+		})
+	}
+}
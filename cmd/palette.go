@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"asciify/cmd/utils"
+	"image/color"
+)
+
+// snapToPalette restricts every cell color to the palette. Foregrounds are dithered across the
+// grid with the given method, backgrounds simply take the nearest entry. Cell alpha is kept.
+func snapToPalette(grid *CellGrid, palette []color.Color, dither utils.DitherMethod) {
+	if len(palette) == 0 {
+		return
+	}
+
+	opaque := func(c color.RGBA) color.RGBA {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		return color.RGBA{n.R, n.G, n.B, 255}
+	}
+
+	foregrounds := make([]color.RGBA, len(grid.Cells))
+	for i, cell := range grid.Cells {
+		foregrounds[i] = opaque(cell.Foreground)
+	}
+	indices := utils.QuantizeToPalette(foregrounds, grid.Width, grid.Height, palette, dither)
+
+	matcher := utils.NewPaletteMatcher(palette)
+	for i := range grid.Cells {
+		cell := &grid.Cells[i]
+		if cell.Foreground.A > 0 {
+			cell.Foreground = utils.WithAlpha(matcher.Color(indices[i]), cell.Foreground.A)
+		}
+		if cell.HasBackground && cell.Background.A > 0 {
+			nearest := matcher.Nearest(opaque(cell.Background))
+			cell.Background = utils.WithAlpha(matcher.Color(nearest), cell.Background.A)
+		}
+	}
+}
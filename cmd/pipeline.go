@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"asciify/cmd/utils"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"slices"
+	"strings"
+)
+
+// StageKind says which part of the pipeline a stage belongs to.
+type StageKind int
+
+const (
+	// StagePreprocess stages work on Frame.Source and Frame.ColorMap before any cell is decided.
+	StagePreprocess StageKind = iota
+	// StageEdges stages find edges and leave them in Frame.Edges or Frame.Intensity.
+	StageEdges
+	// StageGlyphs stages fill Frame.Grid with characters and the raw colors they were picked for.
+	StageGlyphs
+	// StageColors stages decide the final cell colors.
+	StageColors
+	// StageRender stages rasterize Frame.Grid into Frame.Image.
+	StageRender
+	// StagePostprocess stages apply effects to Frame.Image.
+	StagePostprocess
+)
+
+func (k StageKind) String() string {
+	switch k {
+	case StagePreprocess:
+		return "preprocess"
+	case StageEdges:
+		return "edges"
+	case StageGlyphs:
+		return "glyphs"
+	case StageColors:
+		return "colors"
+	case StageRender:
+		return "render"
+	case StagePostprocess:
+		return "postprocess"
+	}
+	return fmt.Sprintf("StageKind(%d)", int(k))
+}
+
+// Stage is one step of the pipeline. Run reads what earlier stages left in the frame and adds its
+// own part; long running stages should call Frame.Report now and then, which also tells them
+// when ctx has been cancelled.
+type Stage interface {
+	Name() string
+	Kind() StageKind
+	Run(ctx context.Context, f *Frame) error
+}
+
+// HaloStage is implemented by stages that look at neighbouring cells, such as blurs. Halo is how
+// many cell rows above and below a band they reach, so tiled renders can give bands enough context.
+type HaloStage interface {
+	Stage
+	Halo() int
+}
+
+type stageFunc struct {
+	name string
+	kind StageKind
+	run  func(ctx context.Context, f *Frame) error
+}
+
+func (s stageFunc) Name() string    { return s.name }
+func (s stageFunc) Kind() StageKind { return s.kind }
+
+func (s stageFunc) Run(ctx context.Context, f *Frame) error {
+	return s.run(ctx, f)
+}
+
+// NewStage adapts a plain function to Stage.
+func NewStage(name string, kind StageKind, run func(ctx context.Context, f *Frame) error) Stage {
+	return stageFunc{name, kind, run}
+}
+
+// Frame carries one image through the pipeline.
+type Frame struct {
+	Options Options
+	// Source is the input image, as left by the preprocess stages.
+	Source image.Image
+	// ColorMap has one pixel per cell, or per sub-cell in the block and braille modes.
+	ColorMap image.Image
+	// Edges, if set, holds the edge character of every cell, or ' ' where there is none.
+	Edges [][]rune
+	// Intensity, if set, raises braille dots instead of the luminance of ColorMap.
+	Intensity image.Image
+	// Palette holds the shades of monochrome mode.
+	Palette []color.Color
+	Grid    *CellGrid
+	Image   *image.RGBA
+	// Viewport is where the whole output lies in Image's coordinates. It is Image's bounds unless
+	// Image is only a band of a tiled render.
+	Viewport image.Rectangle
+
+	atlas    *glyphAtlas
+	progress *progressTracker
+	stage    string
+}
+
+// Canvas is the color the cells are drawn on: the matte, or transparent with Options.Transparent.
+func (f *Frame) Canvas() color.Color {
+	if f.Options.Transparent {
+		return color.Transparent
+	}
+	return matteColor(f.Options)
+}
+
+// Report tells the progress reporter that fraction (0 to 1) of the current stage is done. It
+// returns the context's error once the render has been cancelled.
+func (f *Frame) Report(fraction float64) error {
+	return f.progress.update(f.stage, fraction)
+}
+
+var stageRegistry = map[string]Stage{}
+
+// RegisterStage makes a stage available by name to Options.Stages. It is meant to be called
+// from init functions and panics if the name is taken.
+func RegisterStage(stage Stage) {
+	if _, exists := stageRegistry[stage.Name()]; exists {
+		panic("asciify: stage " + stage.Name() + " registered twice")
+	}
+	stageRegistry[stage.Name()] = stage
+}
+
+// StageNames lists every registered stage, sorted.
+func StageNames() []string {
+	names := make([]string, 0, len(stageRegistry))
+	for name := range stageRegistry {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Pipeline is an ordered list of stages that turns an image into its rendered ASCII version.
+type Pipeline struct {
+	opts   Options
+	stages []Stage
+	atlas  *glyphAtlas
+}
+
+// NewPipeline builds the pipeline for opts: the stages named in opts.Stages, or DefaultStages.
+func NewPipeline(opts Options) (*Pipeline, error) {
+	stages, err := resolveStages(opts)
+	if err != nil {
+		return nil, err
+	}
+	face, err := loadFace(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Pipeline{opts: opts, stages: stages, atlas: newGlyphAtlas(face)}, nil
+}
+
+// WithOptions returns the pipeline for opts, sharing p's loaded font and glyph cache unless opts
+// asks for another font or scale. Pipelines are safe to run concurrently.
+func (p *Pipeline) WithOptions(opts Options) (*Pipeline, error) {
+	if opts.FontPath != p.opts.FontPath || opts.ScaleFactor != p.opts.ScaleFactor {
+		return NewPipeline(opts)
+	}
+	stages, err := resolveStages(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Pipeline{opts: opts, stages: stages, atlas: p.atlas}, nil
+}
+
+// Options returns the options the pipeline was built for.
+func (p *Pipeline) Options() Options {
+	return p.opts
+}
+
+func resolveStages(opts Options) ([]Stage, error) {
+	names := opts.Stages
+	if len(names) == 0 {
+		names = DefaultStages(opts)
+	}
+
+	var stages []Stage
+	for _, name := range names {
+		stage, ok := stageRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q, known stages are %s", name, strings.Join(StageNames(), ", "))
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// Stages returns the names of the pipeline's stages in order.
+func (p *Pipeline) Stages() []string {
+	names := make([]string, len(p.stages))
+	for i, stage := range p.stages {
+		names[i] = stage.Name()
+	}
+	return names
+}
+
+func (p *Pipeline) index(name string) (int, error) {
+	for i, stage := range p.stages {
+		if stage.Name() == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("pipeline has no stage %q", name)
+}
+
+// Add inserts stage after the last stage of the same or an earlier kind, so a custom colorizer
+// runs after the built-in ones but before rendering.
+func (p *Pipeline) Add(stage Stage) {
+	i := len(p.stages)
+	for i > 0 && p.stages[i-1].Kind() > stage.Kind() {
+		i--
+	}
+	p.stages = slices.Insert(p.stages, i, stage)
+}
+
+// InsertBefore inserts stage right before the stage called name.
+func (p *Pipeline) InsertBefore(name string, stage Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages = slices.Insert(p.stages, i, stage)
+	return nil
+}
+
+// InsertAfter inserts stage right after the stage called name.
+func (p *Pipeline) InsertAfter(name string, stage Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages = slices.Insert(p.stages, i+1, stage)
+	return nil
+}
+
+// Replace swaps the stage called name for stage.
+func (p *Pipeline) Replace(name string, stage Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages[i] = stage
+	return nil
+}
+
+// Remove drops the stage called name.
+func (p *Pipeline) Remove(name string) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages = slices.Delete(p.stages, i, i+1)
+	return nil
+}
+
+// Run takes sourceImage through every stage and returns the final frame, whose Grid and Image
+// hold the result. Progress is reported to the pipeline's Options.Progress.
+func (p *Pipeline) Run(ctx context.Context, sourceImage image.Image) (*Frame, error) {
+	progress := newProgressTracker(ctx, p.opts.Progress, p.Stages())
+	f, err := p.run(progress, sourceImage, image.Rectangle{})
+	if err != nil {
+		return nil, err
+	}
+	progress.finish()
+	return f, nil
+}
+
+func (p *Pipeline) run(progress *progressTracker, sourceImage image.Image, viewport image.Rectangle) (*Frame, error) {
+	f := &Frame{
+		Options:  p.opts,
+		Source:   sourceImage,
+		Palette:  monochromePalette(p.opts),
+		Viewport: viewport,
+		atlas:    p.atlas,
+		progress: progress,
+	}
+	for _, stage := range p.stages {
+		f.stage = stage.Name()
+		if err := progress.stage(f.stage); err != nil {
+			return nil, err
+		}
+		if err := stage.Run(progress.ctx, f); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.stage, err)
+		}
+	}
+	return f, nil
+}
+
+// Render runs the pipeline and saves the image to outputPath, also printing it to
+// Options.Terminal if that is set.
+func (p *Pipeline) Render(ctx context.Context, sourceImage image.Image, outputPath string) error {
+	progress := newProgressTracker(ctx, p.opts.Progress, append(p.Stages(), "save"))
+	f, err := p.run(progress, sourceImage, image.Rectangle{})
+	if err != nil {
+		return err
+	}
+	if f.Image == nil {
+		return fmt.Errorf("pipeline %s has no render stage", strings.Join(p.Stages(), ","))
+	}
+	if p.opts.Terminal != nil && f.Grid != nil {
+		if err := WriteANSI(p.opts.Terminal, f.Grid); err != nil {
+			fmt.Println("Error writing to terminal: ", err)
+		}
+	}
+
+	if err := progress.stage("save"); err != nil {
+		return err
+	}
+	// Save the final image with edge effects
+	if err := utils.SaveImageWithText(f.Image, outputPath, p.opts.Metadata); err != nil {
+		return err
+	}
+	progress.finish()
+	return nil
+}
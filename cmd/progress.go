@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"slices"
+)
+
+// ProgressEvent tells how far a render has come.
+type ProgressEvent struct {
+	// Stage names the pipeline step being worked on, e.g. "edges", "glyphs" or "render".
+	Stage string
+	// Percent is how much of the whole render is done, from 0 to 100.
+	Percent float64
+}
+
+// Progress receives progress events. Report is called on the rendering goroutine, so it should return quickly.
+type Progress interface {
+	Report(event ProgressEvent)
+}
+
+// ProgressFunc adapts a plain function to Progress.
+type ProgressFunc func(event ProgressEvent)
+
+func (f ProgressFunc) Report(event ProgressEvent) {
+	f(event)
+}
+
+// progressTracker checks for cancellation and turns per-stage progress into overall percentages.
+type progressTracker struct {
+	ctx      context.Context
+	reporter Progress
+	stages   []string
+	// offset and share place this run within the whole render, for renders split into bands
+	offset, share float64
+}
+
+func newProgressTracker(ctx context.Context, reporter Progress, stages []string) *progressTracker {
+	return &progressTracker{ctx: ctx, reporter: reporter, stages: stages, share: 1}
+}
+
+// part returns a tracker for the i-th of n equal parts of this one, such as the bands of a tiled render.
+func (t *progressTracker) part(i, n int) *progressTracker {
+	part := *t
+	part.share = t.share / float64(n)
+	part.offset = t.offset + t.share*float64(i)/float64(n)
+	return &part
+}
+
+// update reports that fraction (0 to 1) of the named stage is done. It returns the context's
+// error once the render has been cancelled, which callers pass up to stop.
+func (t *progressTracker) update(stage string, fraction float64) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	index := slices.Index(t.stages, stage)
+	if t.reporter == nil || index < 0 {
+		return nil
+	}
+	done := (float64(index) + fraction) / float64(len(t.stages))
+	t.reporter.Report(ProgressEvent{Stage: stage, Percent: 100 * (t.offset + t.share*done)})
+	return nil
+}
+
+// stage reports the start of a stage.
+func (t *progressTracker) stage(stage string) error {
+	return t.update(stage, 0)
+}
+
+func (t *progressTracker) finish() {
+	if t.reporter != nil {
+		t.reporter.Report(ProgressEvent{Stage: "done", Percent: 100})
+	}
+}
@@ -2,12 +2,10 @@ package cmd
 
 import (
 	"asciify/cmd/utils"
-	"fmt"
+	"context"
 	"image"
 	"image/color"
 	"math"
-	"runtime"
-	"sync"
 )
 
 func getEdgeDirection(angle float64) color.Color {
@@ -90,7 +88,6 @@ func optimizedShaderMap(angleMap [][]float64, width, height, blockSize int) [][]
 			}
 		}
 	}
-	fmt.Println("Shader map successfully generated.")
 	return shaderMap
 }
 
@@ -136,8 +133,8 @@ func computeShaderMap(angleMap [][]float64, width, height int, blockSize int) im
 	return img
 }
 
-func getSobelFilter(sourceImage image.Image) (image.Image, [][]float64) {
-	// Sobel filter, returns a sobel filtered image and an angle map
+func getSobelFilter(ctx context.Context, sourceImage image.Image, lumModel utils.LuminanceModel) (image.Image, [][]float64, error) {
+	// Sobel filter, returns a sobel filtered image and an angle map, or ctx's error once ctx is done
 	// https://en.wikipedia.org/wiki/Sobel_operator
 	var Gx = [3][3]float64{
 		{1, 0, -1},
@@ -154,8 +151,9 @@ func getSobelFilter(sourceImage image.Image) (image.Image, [][]float64) {
 	// DoG_image := differenceOfGaussians(sourceImage, 1, 4, 0.3, 0.95)
 	// saveImage(DoG_image, "dog.png")
 
-	width := sourceImage.Bounds().Dx()
-	height := sourceImage.Bounds().Dy()
+	src := utils.ToRGBA(sourceImage)
+	width := src.Rect.Dx()
+	height := src.Rect.Dy()
 	img := image.NewGray(sourceImage.Bounds())
 
 	angleMap := make([][]float64, height)
@@ -163,55 +161,58 @@ func getSobelFilter(sourceImage image.Image) (image.Image, [][]float64) {
 		angleMap[i] = make([]float64, width)
 	}
 
-	numWorkers := runtime.NumCPU()
-	fmt.Println("Using", numWorkers, "workers for sobel filter.")
-	chunks := (height + numWorkers - 1) / numWorkers
-
-	var waitGroup sync.WaitGroup
-	for worker := 0; worker < numWorkers; worker++ {
-		startY := max(worker*chunks, 1)
-		endY := min((worker+1)*chunks, height-1)
-
-		waitGroup.Add(1)
-		go func(startY, endY int) {
-			defer waitGroup.Done()
-
-			for y := startY; y < endY; y++ {
-				for x := 1; x < width-1; x++ {
-					pixel_x, pixel_y := 0, 0
-
-					// convolve the image with the kernels
-					for dy := -1; dy < 2; dy++ {
-						for dx := -1; dx < 2; dx++ {
-							lum := utils.GetLuminance(sourceImage.At(x+dx, y+dy)) / 65535.0 * 255
-							pixel_x += int(lum * Gx[dx+1][dy+1])
-							pixel_y += int(lum * Gy[dx+1][dy+1])
-						}
+	// each pixel is part of nine neighborhoods, so compute its luminance once up front
+	lums := make([]float64, width*height)
+	err := utils.ParallelRowsContext(ctx, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src.Pix[y*src.Stride:]
+			for x := 0; x < width; x++ {
+				lums[y*width+x] = lumModel.LuminanceRGBA(row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]) * 255
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = utils.ParallelRowsContext(ctx, height, func(y0, y1 int) {
+		for y := max(y0, 1); y < min(y1, height-1); y++ {
+			for x := 1; x < width-1; x++ {
+				pixel_x, pixel_y := 0, 0
+
+				// convolve the image with the kernels
+				for dy := -1; dy < 2; dy++ {
+					for dx := -1; dx < 2; dx++ {
+						lum := lums[(y+dy)*width+x+dx]
+						pixel_x += int(lum * Gx[dx+1][dy+1])
+						pixel_y += int(lum * Gy[dx+1][dy+1])
 					}
+				}
 
-					// calculate the gradient magnitude
-					magnitude := int(math.Sqrt(float64(pixel_x*pixel_x + pixel_y*pixel_y)))
-					magnitude = int(math.Min(255, float64(magnitude)))
+				// calculate the gradient magnitude
+				magnitude := int(math.Sqrt(float64(pixel_x*pixel_x + pixel_y*pixel_y)))
+				magnitude = int(math.Min(255, float64(magnitude)))
 
-					// normalize angle to range [-1, 1]
-					angle := math.Atan2(float64(pixel_y), float64(pixel_x))
-					angle = angle / math.Pi
+				// normalize angle to range [-1, 1]
+				angle := math.Atan2(float64(pixel_y), float64(pixel_x))
+				angle = angle / math.Pi
 
-					// threshold so we don't get a bunch of noise
-					if magnitude >= 50 {
-						angleMap[y][x] = quantizeAngle(angle)
-					} else {
-						angleMap[y][x] = math.NaN()
-					}
-					// Set the pixel in the new image
-					img.SetGray(x, y, color.Gray{Y: uint8(magnitude)})
+				// threshold so we don't get a bunch of noise
+				if magnitude >= 50 {
+					angleMap[y][x] = quantizeAngle(angle)
+				} else {
+					angleMap[y][x] = math.NaN()
 				}
+				// Set the pixel in the new image
+				img.Pix[y*img.Stride+x] = uint8(magnitude)
 			}
-		}(startY, endY)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	waitGroup.Wait()
-	return img, angleMap
+	return img, angleMap, nil
 }
 
 func quantizeAngle(angle float64) float64 {
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"asciify/cmd/internal/testimage"
+	"asciify/cmd/utils"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// referenceSobel is getSobelFilter pixel by pixel through the color interfaces, as it was before
+// it worked on typed buffers.
+func referenceSobel(sourceImage image.Image, lumModel utils.LuminanceModel) (*image.Gray, [][]float64) {
+	Gx := [3][3]float64{{1, 0, -1}, {2, 0, -2}, {1, 0, -1}}
+	Gy := [3][3]float64{{1, 2, 1}, {0, 0, 0}, {-1, -2, -1}}
+
+	width, height := sourceImage.Bounds().Dx(), sourceImage.Bounds().Dy()
+	img := image.NewGray(sourceImage.Bounds())
+	angleMap := make([][]float64, height)
+	for i := range height {
+		angleMap[i] = make([]float64, width)
+	}
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			pixel_x, pixel_y := 0, 0
+			for dy := -1; dy < 2; dy++ {
+				for dx := -1; dx < 2; dx++ {
+					lum := lumModel.Luminance(sourceImage.At(x+dx, y+dy)) * 255
+					pixel_x += int(lum * Gx[dx+1][dy+1])
+					pixel_y += int(lum * Gy[dx+1][dy+1])
+				}
+			}
+			magnitude := int(math.Min(255, float64(int(math.Sqrt(float64(pixel_x*pixel_x+pixel_y*pixel_y))))))
+			if magnitude >= 50 {
+				angleMap[y][x] = quantizeAngle(math.Atan2(float64(pixel_y), float64(pixel_x)) / math.Pi)
+			} else {
+				angleMap[y][x] = math.NaN()
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(magnitude)})
+		}
+	}
+	return img, angleMap
+}
+
+func TestSobelFilter(t *testing.T) {
+	defer utils.SetWorkers(utils.Workers())
+	sizes := []image.Point{{1, 1}, {2, 5}, {3, 3}, {17, 15}, {67, 33}, {131, 77}}
+	for _, workers := range []int{1, 4} {
+		utils.SetWorkers(workers)
+		for _, size := range sizes {
+			cards := map[string]*image.RGBA{
+				"opaque":      testimage.Card(size.X, size.Y),
+				"translucent": testimage.TranslucentCard(size.X, size.Y),
+			}
+			for name, img := range cards {
+				for _, model := range []utils.LuminanceModel{utils.LuminancePerceptual, utils.LuminanceRec709} {
+					t.Run(fmt.Sprintf("%d workers %s %dx%d %s", workers, name, size.X, size.Y, model), func(t *testing.T) {
+						got, gotAngles, err := getSobelFilter(context.Background(), img, model)
+						if err != nil {
+							t.Fatal(err)
+						}
+						want, wantAngles := referenceSobel(img, model)
+						if string(got.(*image.Gray).Pix) != string(want.Pix) {
+							t.Error("magnitudes differ from the reference")
+						}
+						for y := range wantAngles {
+							for x := range wantAngles[y] {
+								g, w := gotAngles[y][x], wantAngles[y][x]
+								if g != w && !(math.IsNaN(g) && math.IsNaN(w)) {
+									t.Fatalf("angle at (%d, %d) is %v, want %v", x, y, g, w)
+								}
+							}
+						}
+					})
+				}
+			}
+		}
+	}
+}
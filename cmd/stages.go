@@ -0,0 +1,350 @@
+package cmd
+
+import (
+	"asciify/cmd/utils"
+	"context"
+	"errors"
+	"image/color"
+	"path/filepath"
+
+	"github.com/nfnt/resize"
+)
+
+func init() {
+	RegisterStage(NewStage("preprocess", StagePreprocess, preprocessStage))
+	RegisterStage(NewStage("downscale", StagePreprocess, downscaleStage))
+	RegisterStage(NewStage("bloom", StagePreprocess, bloomStage))
+	RegisterStage(NewStage("edges", StageEdges, edgesStage))
+	RegisterStage(NewStage("glyphs", StageGlyphs, glyphsStage))
+	RegisterStage(NewStage("colors", StageColors, colorsStage))
+	RegisterStage(NewStage("cell-bg", StageColors, cellBackgroundStage))
+	RegisterStage(NewStage("palette", StageColors, paletteStage))
+	RegisterStage(NewStage("render", StageRender, renderStage))
+	RegisterStage(NewStage("glow", StagePostprocess, glowStage))
+	RegisterStage(NewStage("composite", StagePostprocess, compositeStage))
+	RegisterStage(NewStage("burn", StagePostprocess, burnStage))
+	RegisterStage(NewStage("crt", StagePostprocess, crtStage))
+}
+
+// DefaultStages lists the built-in stages opts asks for, in order.
+func DefaultStages(opts Options) []string {
+	stages := []string{"preprocess", "downscale"}
+	if opts.Bloom && opts.BloomTarget != BloomGlyphs {
+		stages = append(stages, "bloom")
+	}
+	if opts.Mode.isASCII() || (opts.Mode == ModeBraille && opts.BrailleSource == BrailleEdges) {
+		stages = append(stages, "edges")
+	}
+	stages = append(stages, "glyphs", "colors")
+	if opts.CellBackground != CellBackgroundNone && opts.CellBackground != "" {
+		stages = append(stages, "cell-bg")
+	}
+	if !opts.Monochrome && len(opts.Palette) > 0 {
+		stages = append(stages, "palette")
+	}
+	stages = append(stages, "render")
+	if opts.Bloom && opts.BloomTarget == BloomGlyphs {
+		stages = append(stages, "glow")
+	}
+	if opts.Composite {
+		stages = append(stages, "composite")
+	}
+	if opts.Burn {
+		stages = append(stages, "burn")
+	}
+	if opts.CRT {
+		stages = append(stages, "crt")
+	}
+	return stages
+}
+
+// monochromePalette builds the shades of monochrome mode from the gradient or the base color.
+func monochromePalette(opts Options) []color.Color {
+	shades := opts.Shades
+	if shades < 2 {
+		shades = 8
+	}
+	if len(opts.Gradient) > 0 {
+		return utils.GenerateGradientPalette(opts.Gradient, shades, opts.Progression)
+	}
+	return utils.GenerateSpicedBrightnessPalette(opts.BaseColor, shades, opts.Progression)
+}
+
+var (
+	errNoColorMap = errors.New("no color map, the pipeline needs a downscale stage first")
+	errNoGrid     = errors.New("no cells, the pipeline needs a glyphs stage first")
+	errNoImage    = errors.New("nothing rendered, the pipeline needs a render stage first")
+)
+
+// preprocessStage flattens transparency onto the matte if asked to and applies the tone mapping.
+func preprocessStage(ctx context.Context, f *Frame) error {
+	if f.Options.AlphaMode == AlphaMatte {
+		f.Source = utils.FlattenAlpha(f.Source, matteColor(f.Options))
+		if err := f.Report(0.2); err != nil {
+			return err
+		}
+	}
+	source, err := utils.Preprocess(ctx, f.Source, f.Options.Preprocess)
+	if err != nil {
+		return err
+	}
+	f.Source = source
+	return nil
+}
+
+// downscaleStage samples the source down to one pixel per cell, or per sub-cell in the block modes.
+func downscaleStage(ctx context.Context, f *Frame) error {
+	opts := f.Options
+	if opts.Mode.isASCII() {
+		_, _, f.ColorMap = utils.DownscaleImage(f.Source, opts.ScaleFactor)
+		if opts.DebugDir != "" {
+			return utils.SaveImageWithText(f.ColorMap, filepath.Join(opts.DebugDir, "downscaled.png"), nil)
+		}
+		return nil
+	}
+
+	// block modes sample several pixels per cell instead of one
+	bounds := f.Source.Bounds()
+	subCols, subRows := opts.Mode.subPixels()
+	f.ColorMap = utils.ResizeImage(f.Source, bounds.Dx()/opts.ScaleFactor*subCols, bounds.Dy()/opts.ScaleFactor*subRows)
+	return nil
+}
+
+// bloomStage blooms the color map, so the glow shows up in the cells' colors and glyphs.
+func bloomStage(ctx context.Context, f *Frame) error {
+	if f.ColorMap == nil {
+		return errNoColorMap
+	}
+	colorMap, err := utils.BloomImage(ctx, f.ColorMap, bloomOptions(f.Options))
+	if err != nil {
+		return err
+	}
+	f.ColorMap = colorMap
+	return nil
+}
+
+// edgesStage runs Sobel on the source. The ASCII mode turns the edge angles into line characters
+// per cell, braille raises its dots from the edge strength instead of the luminance.
+func edgesStage(ctx context.Context, f *Frame) error {
+	if f.ColorMap == nil {
+		return errNoColorMap
+	}
+	opts := f.Options
+	if opts.Mode != ModeBraille && !opts.Mode.isASCII() {
+		return nil
+	}
+	sobel, angleMap, err := getSobelFilter(ctx, f.Source, opts.Luminance)
+	if err != nil {
+		return err
+	}
+	if err := f.Report(0.8); err != nil {
+		return err
+	}
+	if opts.Mode == ModeBraille {
+		bounds := f.ColorMap.Bounds()
+		f.Intensity = resize.Resize(uint(bounds.Dx()), uint(bounds.Dy()), sobel, resize.Lanczos3)
+	} else {
+		bounds := f.Source.Bounds()
+		f.Edges = optimizedShaderMap(angleMap, bounds.Dx(), bounds.Dy(), opts.ScaleFactor)
+	}
+	return nil
+}
+
+// glyphsStage picks every cell's character. Cells keep the color they were picked for, the
+// colors stages take it from there. Cells below the alpha threshold are left empty.
+func glyphsStage(ctx context.Context, f *Frame) error {
+	if f.ColorMap == nil {
+		return errNoColorMap
+	}
+	opts := f.Options
+	switch opts.Mode {
+	case ModeHalfBlock, ModeQuadrant, ModeSextant:
+		f.Grid = buildBlockGrid(f.ColorMap, opts.Mode, opts.Luminance)
+	case ModeBraille:
+		intensity := f.ColorMap
+		if f.Intensity != nil {
+			intensity = f.Intensity
+		}
+		f.Grid = buildBrailleGrid(intensity, f.ColorMap, opts.BrailleThreshold, opts.Dither, opts.Luminance)
+	default:
+		if err := selectASCIIGlyphs(f); err != nil {
+			return err
+		}
+	}
+	clearTransparentCells(f.Grid, opts.AlphaThreshold)
+	return nil
+}
+
+// selectASCIIGlyphs maps each cell's luminance onto the character ramp, unless it lies on an edge.
+func selectASCIIGlyphs(f *Frame) error {
+	opts := f.Options
+	bounds := f.ColorMap.Bounds()
+	grid := NewCellGrid(bounds.Dx(), bounds.Dy())
+
+	// With dithering, ramp levels are chosen for the whole image at once
+	// so the quantization error can be spread over neighboring cells.
+	var glyphLevels []int
+	if dithered(opts.Dither) {
+		lums := make([]float64, grid.Width*grid.Height)
+		for y := 0; y < grid.Height; y++ {
+			for x := 0; x < grid.Width; x++ {
+				lums[y*grid.Width+x] = opts.Luminance.Luminance(f.ColorMap.At(bounds.Min.X+x, bounds.Min.Y+y))
+			}
+		}
+		glyphLevels = utils.Quantize(lums, grid.Width, grid.Height, utils.AsciiRampSize(), 0.5, opts.Dither)
+	}
+
+	for y := 0; y < grid.Height; y++ {
+		if err := f.Report(float64(y) / float64(grid.Height)); err != nil {
+			return err
+		}
+		for x := 0; x < grid.Width; x++ {
+			i := y*grid.Width + x
+
+			// Default character based on luminance
+			c := f.ColorMap.At(bounds.Min.X+x, bounds.Min.Y+y)
+			asciiChar := opts.Luminance.Character(c)
+			if glyphLevels != nil {
+				asciiChar = utils.GetRampCharacter(glyphLevels[i])
+			}
+			if f.Edges != nil && f.Edges[y][x] != ' ' {
+				asciiChar = f.Edges[y][x]
+			}
+
+			cell := &grid.Cells[i]
+			cell.Char = asciiChar
+			cell.Foreground = color.RGBAModel.Convert(c).(color.RGBA)
+		}
+	}
+	f.Grid = grid
+	return nil
+}
+
+func dithered(method utils.DitherMethod) bool {
+	return method != utils.DitherNone && method != ""
+}
+
+// colorsStage maps the cell colors onto the palette shades in monochrome mode. The ASCII mode
+// dithers the shades over neighbouring cells when dithering is on.
+func colorsStage(ctx context.Context, f *Frame) error {
+	if f.Grid == nil {
+		return errNoGrid
+	}
+	opts := f.Options
+	if !opts.Monochrome {
+		return nil
+	}
+	grid, palette := f.Grid, f.Palette
+
+	if opts.Mode.isASCII() && dithered(opts.Dither) {
+		lums := make([]float64, len(grid.Cells))
+		for i, cell := range grid.Cells {
+			lums[i] = opts.Luminance.Luminance(cell.Foreground)
+		}
+		levels := utils.Quantize(lums, grid.Width, grid.Height, len(palette), 0.5, opts.Dither)
+		for i := range grid.Cells {
+			cell := &grid.Cells[i]
+			cell.Foreground = utils.WithAlpha(palette[levels[i]], cell.Foreground.A)
+		}
+		return nil
+	}
+
+	shade := func(c color.RGBA) color.RGBA {
+		lum := opts.Luminance.Luminance(c)
+		return utils.WithAlpha(palette[uint(lum*float64(len(palette)-1))], c.A)
+	}
+	for i := range grid.Cells {
+		cell := &grid.Cells[i]
+		cell.Foreground = shade(cell.Foreground)
+		if cell.HasBackground {
+			cell.Background = shade(cell.Background)
+		}
+	}
+	return nil
+}
+
+func cellBackgroundStage(ctx context.Context, f *Frame) error {
+	if f.Grid == nil {
+		return errNoGrid
+	}
+	applyCellBackgrounds(f.Grid, f.Options, f.Palette)
+	return nil
+}
+
+func paletteStage(ctx context.Context, f *Frame) error {
+	if f.Grid == nil {
+		return errNoGrid
+	}
+	snapToPalette(f.Grid, f.Options.Palette, f.Options.PaletteDither)
+	return nil
+}
+
+// renderStage draws the grid onto the matte, or a transparent canvas.
+func renderStage(ctx context.Context, f *Frame) error {
+	if f.Grid == nil {
+		return errNoGrid
+	}
+	img, err := renderCellGrid(f.Report, f.Grid, f.atlas, f.Options.ScaleFactor, f.Canvas())
+	if err != nil {
+		return err
+	}
+	f.Image = img
+	if f.Viewport.Empty() {
+		f.Viewport = img.Bounds()
+	}
+	return nil
+}
+
+func glowStage(ctx context.Context, f *Frame) error {
+	if f.Image == nil {
+		return errNoImage
+	}
+	img, err := utils.GlowImage(ctx, f.Image, bloomOptions(f.Options))
+	if err != nil {
+		return err
+	}
+	f.Image = img
+	return nil
+}
+
+func compositeStage(ctx context.Context, f *Frame) error {
+	if f.Image == nil {
+		return errNoImage
+	}
+	img, err := compositeOverSource(ctx, f.Report, f.Image, f.Source, f.Options)
+	if err != nil {
+		return err
+	}
+	f.Image = img
+	return nil
+}
+
+// burnStage brightens the render, or blends it onto itself with Options.BurnMode.
+func burnStage(ctx context.Context, f *Frame) error {
+	if f.Image == nil {
+		return errNoImage
+	}
+	if f.Options.BurnMode == "" {
+		f.Image = utils.ApplyColorBurn(f.Image, 1.2)
+		return nil
+	}
+	strength := f.Options.BurnStrength
+	if strength == 0 {
+		strength = 0.5
+	}
+	img, err := utils.BlendImagesContext(ctx, f.Image, f.Image, f.Options.BurnMode, strength)
+	if err != nil {
+		return err
+	}
+	f.Image = img
+	return nil
+}
+
+// crtStage lays scanlines and a vignette over the viewport.
+func crtStage(ctx context.Context, f *Frame) error {
+	if f.Image == nil {
+		return errNoImage
+	}
+	f.Image = utils.ApplyCRTFrame(f.Image, f.Viewport, max(f.Options.ScaleFactor/4, 2), 1)
+	return nil
+}
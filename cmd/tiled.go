@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"asciify/cmd/utils"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"strings"
+)
+
+const defaultTileRows = 64
+
+// tileHalo is how many cell rows a band needs above and below it so that every kernel reaching
+// into the band's own rows sees the same pixels as it would on the whole image.
+func tileHalo(opts Options, stages []Stage) int {
+	scale := opts.ScaleFactor
+	// Sobel and the Lanczos resampling reach a few source pixels past the band,
+	// and the shader map looks one row into the next cell
+	halo := 2
+
+	bloomOpts := bloomOptions(opts)
+	radius := int(max(bloomOpts.Radius, 1))
+	for _, stage := range stages {
+		switch stage.Name() {
+		case "bloom":
+			// source bloom is blurred in (sub-)cell pixels
+			halo += radius
+		case "glow":
+			glowRadius := radius
+			for _, r := range bloomOpts.Radii {
+				glowRadius = max(glowRadius, int(r))
+			}
+			if len(bloomOpts.Radii) == 0 {
+				glowRadius *= 4
+			}
+			// glyph glow is blurred in output pixels
+			halo += (glowRadius + scale - 1) / scale
+		case "composite":
+			halo += (int(opts.CompositeBlur) + scale - 1) / scale
+		}
+		if stage, ok := stage.(HaloStage); ok {
+			halo += stage.Halo()
+		}
+	}
+
+	// keep bands aligned to the 4x4 ordered dither matrix
+	return (halo + 3) / 4 * 4
+}
+
+// CheckTiled reports options that can't be used with AsciifyImageTiled.
+func CheckTiled(opts Options) error {
+	if opts.Preprocess.NeedsWholeImage() {
+		return errors.New("auto-levels, histogram equalization and CLAHE need the whole image and can't be tiled")
+	}
+	return nil
+}
+
+// AsciifyImageTiled renders the image like AsciifyImage, but band by band with RenderTiled.
+func AsciifyImageTiled(ctx context.Context, sourceImage image.Image, outputPath string, opts Options) error {
+	pipeline, err := NewPipeline(opts)
+	if err != nil {
+		return err
+	}
+	return pipeline.RenderTiled(ctx, sourceImage, outputPath)
+}
+
+// RenderTiled renders the image in bands of Options.TileRows cell rows and streams each band to
+// the output PNG as soon as it is done, so the pipeline's intermediate images are bounded by the
+// band size rather than the image size. sourceImage itself is read band by band but has to be
+// decoded in full by the caller. Every band is processed with a halo of extra rows that is cut off
+// again, so edges, blurs and glows continue seamlessly across band borders. Error diffusion
+// dithering restarts in each band's halo and can show faint seams. The image is cropped to whole
+// cells like utils.BoundImageToScaleMultiple does. A cancelled render leaves a truncated file.
+func (p *Pipeline) RenderTiled(ctx context.Context, sourceImage image.Image, outputPath string) error {
+	opts := p.opts
+	if err := CheckTiled(opts); err != nil {
+		return err
+	}
+	// debug images would be overwritten by every band
+	bandPipeline := *p
+	bandPipeline.opts.DebugDir = ""
+
+	scale := opts.ScaleFactor
+	bounds := utils.ScaleMultipleBounds(sourceImage.Bounds(), scale)
+	cols, rows := bounds.Dx()/scale, bounds.Dy()/scale
+	tileRows := opts.TileRows
+	if tileRows <= 0 {
+		tileRows = defaultTileRows
+	}
+	tileRows = (tileRows + 3) / 4 * 4
+	halo := tileHalo(opts, p.stages)
+	bands := (rows + tileRows - 1) / tileRows
+	frame := image.Rect(0, 0, cols*scale, rows*scale)
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	defer outputFile.Close()
+
+	png, err := utils.NewPNGStreamWriter(outputFile, cols*scale, rows*scale)
+	if err != nil {
+		return fmt.Errorf("error encoding image: %w", err)
+	}
+	if err := png.WriteText(opts.Metadata); err != nil {
+		return fmt.Errorf("error encoding image: %w", err)
+	}
+
+	progress := newProgressTracker(ctx, opts.Progress, append(p.Stages(), "save"))
+	for band := 0; band < bands; band++ {
+		r0 := band * tileRows
+		r1 := min(r0+tileRows, rows)
+		h0, h1 := max(r0-halo, 0), min(r1+halo, rows)
+		bandProgress := progress.part(band, bands)
+
+		tile := image.NewRGBA(image.Rect(0, 0, cols*scale, (h1-h0)*scale))
+		draw.Draw(tile, tile.Bounds(), sourceImage, bounds.Min.Add(image.Pt(0, h0*scale)), draw.Src)
+
+		f, err := bandPipeline.run(bandProgress, tile, frame.Sub(image.Pt(0, h0*scale)))
+		if err != nil {
+			return err
+		}
+		if f.Image == nil {
+			return fmt.Errorf("pipeline %s has no render stage", strings.Join(p.Stages(), ","))
+		}
+		if opts.Terminal != nil && f.Grid != nil {
+			if err := WriteANSI(opts.Terminal, f.Grid.Rows(r0-h0, r1-h0)); err != nil {
+				fmt.Println("Error writing to terminal: ", err)
+			}
+		}
+
+		if err := bandProgress.stage("save"); err != nil {
+			return err
+		}
+		img := f.Image.SubImage(image.Rect(0, (r0-h0)*scale, cols*scale, (r1-h0)*scale)).(*image.RGBA)
+		if err := png.WriteRows(img); err != nil {
+			return fmt.Errorf("error encoding image: %w", err)
+		}
+	}
+
+	if err := png.Close(); err != nil {
+		return fmt.Errorf("error encoding image: %w", err)
+	}
+	progress.finish()
+	return nil
+}
@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"asciify/cmd/internal/testimage"
+	"context"
+	"image"
+	"testing"
+)
+
+func BenchmarkExtractHighlights(b *testing.B) {
+	testimage.Benchmark(b, func(img *image.RGBA) { ExtractHighlights(img, 200, 20, LuminanceRec709) })
+}
+
+func BenchmarkBlendImages(b *testing.B) {
+	testimage.Benchmark(b, func(img *image.RGBA) { BlendImages(img, img, BlendColorBurn, 0.5) })
+}
+
+func BenchmarkStackBlur(b *testing.B) {
+	testimage.Benchmark(b, func(img *image.RGBA) { StackBlur(context.Background(), img, 6) })
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// BlendMode is a layer blend mode as found in image editors. The formulas work on
+// channel values between 0.0 and 1.0, with base being the bottom layer and top the one blended onto it.
+type BlendMode string
+
+const (
+	BlendNormal     BlendMode = "normal"
+	BlendMultiply   BlendMode = "multiply"
+	BlendScreen     BlendMode = "screen"
+	BlendOverlay    BlendMode = "overlay"
+	BlendSoftLight  BlendMode = "soft-light"
+	BlendColorBurn  BlendMode = "color-burn"
+	BlendColorDodge BlendMode = "color-dodge"
+	BlendAdditive   BlendMode = "additive"
+	BlendDifference BlendMode = "difference"
+)
+
+func ParseBlendMode(s string) (BlendMode, error) {
+	switch mode := BlendMode(s); mode {
+	case BlendNormal, BlendMultiply, BlendScreen, BlendOverlay, BlendSoftLight,
+		BlendColorBurn, BlendColorDodge, BlendAdditive, BlendDifference:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown blend mode %q", s)
+}
+
+// BlendChannel blends a single channel.
+func BlendChannel(mode BlendMode, base, top float64) float64 {
+	switch mode {
+	case BlendMultiply:
+		return base * top
+	case BlendScreen:
+		return 1 - (1-base)*(1-top)
+	case BlendOverlay:
+		if base < 0.5 {
+			return 2 * base * top
+		}
+		return 1 - 2*(1-base)*(1-top)
+	case BlendSoftLight:
+		// W3C compositing spec formula
+		if top <= 0.5 {
+			return base - (1-2*top)*base*(1-base)
+		}
+		var d float64
+		if base <= 0.25 {
+			d = ((16*base-12)*base + 4) * base
+		} else {
+			d = math.Sqrt(base)
+		}
+		return base + (2*top-1)*(d-base)
+	case BlendColorBurn:
+		if base >= 1 {
+			return 1
+		}
+		if top <= 0 {
+			return 0
+		}
+		return 1 - math.Min(1, (1-base)/top)
+	case BlendColorDodge:
+		if base <= 0 {
+			return 0
+		}
+		if top >= 1 {
+			return 1
+		}
+		return math.Min(1, base/(1-top))
+	case BlendAdditive:
+		return math.Min(1, base+top)
+	case BlendDifference:
+		return math.Abs(base - top)
+	}
+	return top
+}
+
+// BlendImages blends top onto base and mixes the result with base by strength (0 to 1), weighted by
+// top's alpha. Both images are read in base's coordinate space; the result keeps base's alpha.
+func BlendImages(base, top image.Image, mode BlendMode, strength float64) *image.RGBA {
+	blended, _ := BlendImagesContext(context.Background(), base, top, mode, strength)
+	return blended
+}
+
+// BlendImagesContext is BlendImages for blends that can be cancelled. It stops early with ctx's
+// error once ctx is done.
+func BlendImagesContext(ctx context.Context, base, top image.Image, mode BlendMode, strength float64) (*image.RGBA, error) {
+	baseRGBA := ToRGBA(base)
+	topNRGBA := topLayer(top, baseRGBA.Rect)
+	blended := image.NewRGBA(baseRGBA.Rect)
+	strength = Clamp(strength, 0, 1)
+
+	err := ParallelRowsContext(ctx, baseRGBA.Rect.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			b, out := rowPix(baseRGBA, y), rowPix(blended, y)
+			t := topNRGBA.Pix[y*topNRGBA.Stride:]
+			for i := 0; i < len(b); i += 4 {
+				if b[i+3] == 0 {
+					continue
+				}
+
+				// blend the un-premultiplied colors
+				alpha := float64(b[i+3])
+				baseR, baseG, baseB := float64(b[i])/alpha, float64(b[i+1])/alpha, float64(b[i+2])/alpha
+				topR, topG, topB := float64(t[i])/255, float64(t[i+1])/255, float64(t[i+2])/255
+				mix := strength * float64(t[i+3]) / 255
+
+				r := baseR + (BlendChannel(mode, baseR, topR)-baseR)*mix
+				g := baseG + (BlendChannel(mode, baseG, topG)-baseG)*mix
+				bl := baseB + (BlendChannel(mode, baseB, topB)-baseB)*mix
+
+				out[i] = uint8(Clamp(r*alpha, 0, 255))
+				out[i+1] = uint8(Clamp(g*alpha, 0, 255))
+				out[i+2] = uint8(Clamp(bl*alpha, 0, 255))
+				out[i+3] = b[i+3]
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blended, nil
+}
+
+// topLayer returns top as un-premultiplied pixels covering exactly bounds.
+func topLayer(top image.Image, bounds image.Rectangle) *image.NRGBA {
+	if top.Bounds() == bounds {
+		return toNRGBA(top)
+	}
+	layer := image.NewNRGBA(bounds)
+	draw.Draw(layer, bounds, top, bounds.Min, draw.Src)
+	return layer
+}
+
+// ApplyCRT overlays scanlines and a vignette on the image using a multiply blend.
+func ApplyCRT(img image.Image, scanlineSpacing int, strength float64) *image.RGBA {
+	return ApplyCRTFrame(img, img.Bounds(), scanlineSpacing, strength)
+}
+
+// ApplyCRTFrame is ApplyCRT for a part of a larger image: scanlines and the vignette are laid out
+// over frame, in img's coordinate space, so separately processed parts line up.
+func ApplyCRTFrame(img image.Image, frame image.Rectangle, scanlineSpacing int, strength float64) *image.RGBA {
+	bounds := img.Bounds()
+	overlay := image.NewGray(bounds)
+	width := bounds.Dx()
+	cx, cy := float64(frame.Min.X+frame.Max.X)/2, float64(frame.Min.Y+frame.Max.Y)/2
+	maxDist := math.Hypot(float64(frame.Dx())/2, float64(frame.Dy())/2)
+
+	ParallelRows(bounds.Dy(), func(y0, y1 int) {
+		for row := y0; row < y1; row++ {
+			y := bounds.Min.Y + row
+			scanline := 1.0
+			if scanlineSpacing > 1 && (y-frame.Min.Y)%scanlineSpacing == scanlineSpacing-1 {
+				scanline = 0.55
+			}
+			pix := overlay.Pix[row*overlay.Stride : row*overlay.Stride+width]
+			for i := range pix {
+				x := bounds.Min.X + i
+				dist := math.Hypot(float64(x)-cx, float64(y)-cy) / maxDist
+				vignette := 1 - 0.6*dist*dist
+				pix[i] = uint8(Clamp(scanline*vignette*255, 0, 255))
+			}
+		}
+	})
+
+	return BlendImages(img, overlay, BlendMultiply, strength)
+}
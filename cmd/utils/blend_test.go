@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"asciify/cmd/internal/testimage"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// referenceBlend is BlendImages pixel by pixel through the color interfaces, as it was before it
+// worked on typed buffers.
+func referenceBlend(base, top image.Image, mode BlendMode, strength float64) *image.RGBA {
+	bounds := base.Bounds()
+	blended := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			br, bg, bb, ba := base.At(x, y).RGBA()
+			tc := color.NRGBAModel.Convert(top.At(x, y)).(color.NRGBA)
+			if ba == 0 {
+				continue
+			}
+
+			alpha := float64(ba)
+			baseR, baseG, baseB := float64(br)/alpha, float64(bg)/alpha, float64(bb)/alpha
+			topR, topG, topB := float64(tc.R)/255, float64(tc.G)/255, float64(tc.B)/255
+			mix := Clamp(strength, 0, 1) * float64(tc.A) / 255
+
+			r := baseR + (BlendChannel(mode, baseR, topR)-baseR)*mix
+			g := baseG + (BlendChannel(mode, baseG, topG)-baseG)*mix
+			b := baseB + (BlendChannel(mode, baseB, topB)-baseB)*mix
+
+			a := alpha / 65535 * 255
+			blended.SetRGBA(x, y, color.RGBA{
+				uint8(Clamp(r*a, 0, 255)),
+				uint8(Clamp(g*a, 0, 255)),
+				uint8(Clamp(b*a, 0, 255)),
+				uint8(a),
+			})
+		}
+	}
+	return blended
+}
+
+func TestBlendImages(t *testing.T) {
+	modes := []BlendMode{BlendNormal, BlendMultiply, BlendScreen, BlendOverlay, BlendSoftLight, BlendColorBurn, BlendColorDodge, BlendAdditive, BlendDifference}
+	withWorkers(t, func(t *testing.T) {
+		for name, base := range testImages() {
+			bounds := base.Bounds()
+			tops := map[string]image.Image{
+				"self":        base,
+				"translucent": testimage.TranslucentCard(bounds.Max.X+3, bounds.Max.Y+5).SubImage(bounds),
+				"uniform":     image.NewUniform(color.Gray{Y: 77}),
+			}
+			for topName, top := range tops {
+				for _, mode := range modes {
+					t.Run(fmt.Sprintf("%s over %s %s", topName, name, mode), func(t *testing.T) {
+						got := BlendImages(base, top, mode, 0.7)
+						want := referenceBlend(base, top, mode, 0.7)
+						if got.Rect != want.Rect {
+							t.Fatalf("bounds %v, want %v", got.Rect, want.Rect)
+						}
+						for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+							for x := bounds.Min.X; x < bounds.Max.X; x++ {
+								if g, w := got.RGBAAt(x, y), want.RGBAAt(x, y); g != w {
+									t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, g, w)
+								}
+							}
+						}
+					})
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+type DitherMethod string
+
+const (
+	DitherNone           DitherMethod = "none"
+	DitherOrdered        DitherMethod = "ordered"
+	DitherFloydSteinberg DitherMethod = "floyd-steinberg"
+	DitherAtkinson       DitherMethod = "atkinson"
+	DitherJarvis         DitherMethod = "jarvis"
+)
+
+func ParseDitherMethod(s string) (DitherMethod, error) {
+	switch method := DitherMethod(s); method {
+	case DitherNone, DitherOrdered, DitherFloydSteinberg, DitherAtkinson, DitherJarvis:
+		return method, nil
+	case "":
+		return DitherNone, nil
+	}
+	return "", fmt.Errorf("unknown dither method %q", s)
+}
+
+// 4x4 Bayer matrix, normalized to (0, 1) when divided by 16
+var bayer4x4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// Quantize maps values in [0, 1] laid out row by row in a width x height grid to
+// level indices in [0, levels). threshold shifts the decision point between levels:
+// 0.5 rounds to the nearest level, lower values push towards the brighter level.
+func Quantize(values []float64, width, height, levels int, threshold float64, method DitherMethod) []int {
+	indices := make([]int, len(values))
+	steps := float64(levels - 1)
+	bias := 0.5 - threshold
+
+	quantize := func(v float64) int {
+		return int(Clamp(math.Floor(v*steps+0.5+bias), 0, steps))
+	}
+
+	switch method {
+	case DitherOrdered:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := y*width + x
+				// spread the bayer offset over one quantization step
+				offset := (bayer4x4[y%4][x%4]+0.5)/16.0 - 0.5
+				indices[i] = quantize(values[i] + offset/steps)
+			}
+		}
+
+	case DitherFloydSteinberg, DitherAtkinson, DitherJarvis:
+		diffuseError(values, indices, width, height, steps, quantize, diffusionKernels[method])
+
+	default:
+		for i, v := range values {
+			indices[i] = quantize(v)
+		}
+	}
+
+	return indices
+}
+
+type errorWeight struct {
+	dx, dy int
+	weight float64
+}
+
+var diffusionKernels = map[DitherMethod][]errorWeight{
+	DitherFloydSteinberg: {
+		{1, 0, 7.0 / 16.0},
+		{-1, 1, 3.0 / 16.0},
+		{0, 1, 5.0 / 16.0},
+		{1, 1, 1.0 / 16.0},
+	},
+	// only 6/8 of the error is diffused, which keeps highlights and shadows clean
+	DitherAtkinson: {
+		{1, 0, 1.0 / 8.0}, {2, 0, 1.0 / 8.0},
+		{-1, 1, 1.0 / 8.0}, {0, 1, 1.0 / 8.0}, {1, 1, 1.0 / 8.0},
+		{0, 2, 1.0 / 8.0},
+	},
+	// Jarvis, Judice & Ninke spreads the error over 12 neighbors for smoother gradients
+	DitherJarvis: {
+		{1, 0, 7.0 / 48.0}, {2, 0, 5.0 / 48.0},
+		{-2, 1, 3.0 / 48.0}, {-1, 1, 5.0 / 48.0}, {0, 1, 7.0 / 48.0}, {1, 1, 5.0 / 48.0}, {2, 1, 3.0 / 48.0},
+		{-2, 2, 1.0 / 48.0}, {-1, 2, 3.0 / 48.0}, {0, 2, 5.0 / 48.0}, {1, 2, 3.0 / 48.0}, {2, 2, 1.0 / 48.0},
+	},
+}
+
+// diffuseError quantizes the grid left to right, top to bottom, pushing the
+// quantization error of each value onto its not-yet-visited neighbors.
+func diffuseError(values []float64, indices []int, width, height int, steps float64, quantize func(float64) int, kernel []errorWeight) {
+	work := make([]float64, len(values))
+	copy(work, values)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			level := quantize(work[i])
+			indices[i] = level
+			quantError := work[i] - float64(level)/steps
+
+			for _, k := range kernel {
+				nx, ny := x+k.dx, y+k.dy
+				if nx < 0 || nx >= width || ny >= height {
+					continue
+				}
+				work[ny*width+nx] += quantError * k.weight
+			}
+		}
+	}
+}
+
+// QuantizeToPalette maps opaque colors laid out row by row in a width x height grid to the index of
+// the closest palette entry, dithering the color error with the given method.
+func QuantizeToPalette(colors []color.RGBA, width, height int, palette []color.Color, method DitherMethod) []int {
+	matcher := NewPaletteMatcher(palette)
+	indices := make([]int, len(colors))
+
+	work := make([][3]float64, len(colors))
+	for i, c := range colors {
+		work[i] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+	}
+
+	kernel := diffusionKernels[method]
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			v := work[i]
+			if method == DitherOrdered {
+				// a palette has no even steps, so spread the bayer offset over a fixed range
+				offset := ((bayer4x4[y%4][x%4]+0.5)/16.0 - 0.5) * 64
+				v = [3]float64{v[0] + offset, v[1] + offset, v[2] + offset}
+			}
+
+			index := matcher.Nearest(color.RGBA{
+				uint8(Clamp(v[0], 0, 255)),
+				uint8(Clamp(v[1], 0, 255)),
+				uint8(Clamp(v[2], 0, 255)),
+				255,
+			})
+			indices[i] = index
+
+			if kernel == nil {
+				continue
+			}
+			chosen := matcher.colors[index]
+			quantError := [3]float64{v[0] - float64(chosen.R), v[1] - float64(chosen.G), v[2] - float64(chosen.B)}
+			for _, k := range kernel {
+				nx, ny := x+k.dx, y+k.dy
+				if nx < 0 || nx >= width || ny >= height {
+					continue
+				}
+				n := &work[ny*width+nx]
+				n[0] += quantError[0] * k.weight
+				n[1] += quantError[1] * k.weight
+				n[2] += quantError[2] * k.weight
+			}
+		}
+	}
+
+	return indices
+}
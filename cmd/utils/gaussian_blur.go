@@ -54,71 +54,58 @@ func GaussianKernel(sigma float64) []float64 {
 	return kernel
 }
 
-func FastGaussianBlur(img image.Image, sigma float64) image.Image {
-	width := img.Bounds().Dx()
-	height := img.Bounds().Dy()
-
-	// horizontal blur
+// FastGaussianBlur blurs img with a separable Gaussian kernel, one horizontal and one vertical pass.
+// The kernel is renormalized where it hangs over the border of the image.
+func FastGaussianBlur(img image.Image, sigma float64) *image.RGBA {
+	src := ToRGBA(img)
+	width, height := src.Rect.Dx(), src.Rect.Dy()
 	kernel := GaussianKernel(sigma)
 	kernelSize := len(kernel) / 2
-	horizontal := image.NewRGBA(img.Bounds())
-
-	for y := 0; y < height; y++ {
-		for x := kernelSize; x < width-kernelSize; x++ {
-			var sumR, sumG, sumB float64
-			var kernelSum float64
 
-			for dx := -kernelSize; dx <= kernelSize; dx++ {
-				if x+dx < 0 || x+dx >= width {
-					continue
+	// both passes accumulate in float32 scratch rows to avoid rounding twice
+	horizontal := make([]float32, width*height*3)
+	ParallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			in := rowPix(src, y)
+			out := horizontal[y*width*3 : (y+1)*width*3]
+			for x := 0; x < width; x++ {
+				var sumR, sumG, sumB, kernelSum float64
+				for dx := max(-kernelSize, -x); dx <= min(kernelSize, width-1-x); dx++ {
+					weight := kernel[dx+kernelSize]
+					i := (x + dx) * 4
+					sumR += float64(in[i]) * weight
+					sumG += float64(in[i+1]) * weight
+					sumB += float64(in[i+2]) * weight
+					kernelSum += weight
 				}
-				r, g, b, _ := img.At(x+dx, y).RGBA()
-				weight := kernel[dx+kernelSize]
-				sumR += float64(r>>8) * weight
-				sumG += float64(g>>8) * weight
-				sumB += float64(b>>8) * weight
-				kernelSum += weight
-			}
-
-			// Normalize and set the pixel in the horizontal image
-			rgbaColor := color.RGBA{
-				R: uint8(sumR / kernelSum),
-				G: uint8(sumG / kernelSum),
-				B: uint8(sumB / kernelSum),
-				A: 255,
+				out[x*3] = float32(sumR / kernelSum)
+				out[x*3+1] = float32(sumG / kernelSum)
+				out[x*3+2] = float32(sumB / kernelSum)
 			}
-			horizontal.Set(x, y, rgbaColor)
 		}
-	}
-
-	// vertical blur
-	blurred := image.NewRGBA(img.Bounds())
-	for y := 0; y < height; y++ {
-		for x := kernelSize; x < width-kernelSize; x++ {
-			var sumR, sumG, sumB float64
-			var kernelSum float64
-
-			for dy := -kernelSize; dy <= kernelSize; dy++ {
-				if y+dy < 0 || y+dy >= width {
-					continue
+	})
+
+	blurred := image.NewRGBA(src.Rect)
+	ParallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			out := rowPix(blurred, y)
+			for x := 0; x < width; x++ {
+				var sumR, sumG, sumB, kernelSum float64
+				for dy := max(-kernelSize, -y); dy <= min(kernelSize, height-1-y); dy++ {
+					weight := kernel[dy+kernelSize]
+					i := ((y+dy)*width + x) * 3
+					sumR += float64(horizontal[i]) * weight
+					sumG += float64(horizontal[i+1]) * weight
+					sumB += float64(horizontal[i+2]) * weight
+					kernelSum += weight
 				}
-				r, g, b, _ := horizontal.At(x, y+dy).RGBA()
-				weight := kernel[dy+kernelSize]
-				sumR += float64(r>>8) * weight
-				sumG += float64(g>>8) * weight
-				sumB += float64(b>>8) * weight
-				kernelSum += weight
+				out[x*4] = uint8(sumR / kernelSum)
+				out[x*4+1] = uint8(sumG / kernelSum)
+				out[x*4+2] = uint8(sumB / kernelSum)
+				out[x*4+3] = 255
 			}
-
-			rgbaColor := color.RGBA{
-				R: uint8(sumR / kernelSum),
-				G: uint8(sumG / kernelSum),
-				B: uint8(sumB / kernelSum),
-				A: 255,
-			}
-			blurred.Set(x, y, rgbaColor)
 		}
-	}
+	})
 
 	return blurred
 }
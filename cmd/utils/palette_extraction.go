@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type PaletteExtraction string
+
+const (
+	ExtractKMeans    PaletteExtraction = "kmeans"
+	ExtractMedianCut PaletteExtraction = "median-cut"
+)
+
+func ParsePaletteExtraction(s string) (PaletteExtraction, error) {
+	switch method := PaletteExtraction(s); method {
+	case ExtractKMeans, ExtractMedianCut:
+		return method, nil
+	case "":
+		return ExtractKMeans, nil
+	}
+	return "", fmt.Errorf("unknown palette extraction method %q", s)
+}
+
+// ParseAutoPalette recognizes an "auto:N" palette spec, returning N and whether s was one.
+func ParseAutoPalette(s string) (int, bool, error) {
+	count, ok := strings.CutPrefix(s, "auto:")
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return 0, true, fmt.Errorf("invalid palette size %q, expected auto:N with N > 0", count)
+	}
+	return n, true, nil
+}
+
+// ExtractPalette finds up to n dominant colors of img, sorted dark to light so the result can
+// also serve as gradient stops. Median cut recursively splits the color box with the widest
+// channel at its median; k-means refines those boxes' averages by clustering in OKLab.
+// Mostly transparent pixels are ignored.
+func ExtractPalette(img image.Image, n int, method PaletteExtraction) []color.Color {
+	pixels := opaquePixels(img)
+	if len(pixels) == 0 || n < 1 {
+		return nil
+	}
+
+	centers := medianCut(pixels, n)
+	if method == ExtractKMeans {
+		centers = kMeans(pixels, centers, 16)
+	}
+
+	labs := make([][3]float64, len(centers))
+	for i, c := range centers {
+		labs[i][0], labs[i][1], labs[i][2] = RGBToOKLab(c)
+	}
+	sort.Sort(byLightness{centers, labs})
+
+	palette := make([]color.Color, len(centers))
+	for i, c := range centers {
+		palette[i] = c
+	}
+	return palette
+}
+
+func opaquePixels(img image.Image) []color.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewNRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+
+	var pixels []color.RGBA
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		if rgba.Pix[i+3] < 128 {
+			continue
+		}
+		pixels = append(pixels, color.RGBA{rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2], 255})
+	}
+	return pixels
+}
+
+// medianCut returns the average color of up to n boxes.
+func medianCut(pixels []color.RGBA, n int) []color.RGBA {
+	boxes := [][]color.RGBA{pixels}
+	for len(boxes) < n {
+		// split the box whose widest channel range, weighted by its size, is largest
+		best, bestScore, bestChannel := -1, 0.0, 0
+		for i, box := range boxes {
+			channel, width := widestChannel(box)
+			if score := float64(width) * math.Sqrt(float64(len(box))); len(box) > 1 && width > 0 && score > bestScore {
+				best, bestScore, bestChannel = i, score, channel
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.Slice(box, func(a, b int) bool { return channelOf(box[a], bestChannel) < channelOf(box[b], bestChannel) })
+		median := len(box) / 2
+		boxes[best] = box[:median]
+		boxes = append(boxes, box[median:])
+	}
+
+	centers := make([]color.RGBA, len(boxes))
+	for i, box := range boxes {
+		var r, g, b int
+		for _, c := range box {
+			r, g, b = r+int(c.R), g+int(c.G), b+int(c.B)
+		}
+		centers[i] = color.RGBA{uint8(r / len(box)), uint8(g / len(box)), uint8(b / len(box)), 255}
+	}
+	return centers
+}
+
+func channelOf(c color.RGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	}
+	return c.B
+}
+
+func widestChannel(box []color.RGBA) (int, int) {
+	lo := [3]uint8{255, 255, 255}
+	var hi [3]uint8
+	for _, c := range box {
+		for ch := 0; ch < 3; ch++ {
+			v := channelOf(c, ch)
+			lo[ch], hi[ch] = min(lo[ch], v), max(hi[ch], v)
+		}
+	}
+
+	channel, width := 0, 0
+	for ch := 0; ch < 3; ch++ {
+		if w := int(hi[ch]) - int(lo[ch]); w > width {
+			channel, width = ch, w
+		}
+	}
+	return channel, width
+}
+
+// kMeans runs Lloyd's algorithm in OKLab, starting from the given centers.
+func kMeans(pixels []color.RGBA, centers []color.RGBA, iterations int) []color.RGBA {
+	initial := make([]color.Color, len(centers))
+	for i, c := range centers {
+		initial[i] = c
+	}
+	matcher := NewPaletteMatcher(initial)
+
+	labs := make([][3]float64, len(pixels))
+	for i, c := range pixels {
+		labs[i][0], labs[i][1], labs[i][2] = RGBToOKLab(c)
+	}
+
+	for iteration := 0; iteration < iterations; iteration++ {
+		sums := make([][3]float64, len(matcher.labs))
+		counts := make([]int, len(matcher.labs))
+		for i, c := range pixels {
+			cluster := matcher.Nearest(c)
+			sums[cluster][0] += labs[i][0]
+			sums[cluster][1] += labs[i][1]
+			sums[cluster][2] += labs[i][2]
+			counts[cluster]++
+		}
+
+		var next []color.Color
+		moved := false
+		for cluster, sum := range sums {
+			if counts[cluster] == 0 {
+				continue
+			}
+			count := float64(counts[cluster])
+			c := OKLabToRGB(sum[0]/count, sum[1]/count, sum[2]/count)
+			moved = moved || c != matcher.colors[cluster]
+			next = append(next, c)
+		}
+		matcher = NewPaletteMatcher(next)
+		if !moved {
+			break
+		}
+	}
+
+	return matcher.colors
+}
+
+type byLightness struct {
+	colors []color.RGBA
+	labs   [][3]float64
+}
+
+func (s byLightness) Len() int           { return len(s.colors) }
+func (s byLightness) Less(i, j int) bool { return s.labs[i][0] < s.labs[j][0] }
+func (s byLightness) Swap(i, j int) {
+	s.colors[i], s.colors[j] = s.colors[j], s.colors[i]
+	s.labs[i], s.labs[j] = s.labs[j], s.labs[i]
+}
+
+// FormatHexPalette lists the palette as #rrggbb lines, the format read back by LoadPalette.
+func FormatHexPalette(palette []color.Color) string {
+	var sb strings.Builder
+	for _, c := range palette {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		fmt.Fprintf(&sb, "#%02x%02x%02x\n", rgba.R, rgba.G, rgba.B)
+	}
+	return sb.String()
+}
+
+// PaletteSwatch draws the palette as a row of squares.
+func PaletteSwatch(palette []color.Color, size int) *image.RGBA {
+	swatch := image.NewRGBA(image.Rect(0, 0, len(palette)*size, size))
+	for i, c := range palette {
+		draw.Draw(swatch, image.Rect(i*size, 0, (i+1)*size, size), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	return swatch
+}
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// levelPalette builds every combination of the given channel levels, like the
+// hardware palettes of the EGA (4 levels) and the Amstrad CPC (3 levels).
+func levelPalette(levels ...uint8) []color.Color {
+	var palette []color.Color
+	for _, r := range levels {
+		for _, g := range levels {
+			for _, b := range levels {
+				palette = append(palette, color.RGBA{r, g, b, 255})
+			}
+		}
+	}
+	return palette
+}
+
+func hexPalette(hexes ...string) []color.Color {
+	palette, err := ParseHexColorList(strings.Join(hexes, ","))
+	if err != nil {
+		panic(err)
+	}
+	return palette
+}
+
+// NamedPalettes are the built-in retro palettes.
+var NamedPalettes = map[string][]color.Color{
+	"cga": hexPalette(
+		"000000", "0000aa", "00aa00", "00aaaa", "aa0000", "aa00aa", "aa5500", "aaaaaa",
+		"555555", "5555ff", "55ff55", "55ffff", "ff5555", "ff55ff", "ffff55", "ffffff",
+	),
+	"ega": levelPalette(0x00, 0x55, 0xaa, 0xff),
+	// Pepto's measured VIC-II colors
+	"c64": hexPalette(
+		"000000", "ffffff", "68372b", "70a4b2", "6f3d86", "588d43", "352879", "b8c76f",
+		"6f4f25", "433900", "9a6759", "444444", "6c6c6c", "9ad284", "6c5eb5", "959595",
+	),
+	// the gate array mixes each channel at off, half and full intensity
+	"cpc": levelPalette(0x00, 0x80, 0xff),
+	"gameboy": hexPalette(
+		"0f380f", "306230", "8bac0f", "9bbc0f",
+	),
+	"pico8": hexPalette(
+		"000000", "1d2b53", "7e2553", "008751", "ab5236", "5f574f", "c2c3c7", "fff1e8",
+		"ff004d", "ffa300", "ffec27", "00e436", "29adff", "83769c", "ff77a8", "ffccaa",
+	),
+}
+
+// PaletteNames lists the built-in palettes, sorted.
+func PaletteNames() []string {
+	names := make([]string, 0, len(NamedPalettes))
+	for name := range NamedPalettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPalette returns a built-in palette by name, or reads a palette file: GIMP .gpl,
+// Lospec/plain .hex (one color per line), paint.net .txt, or Lospec .json.
+func LoadPalette(nameOrPath string) ([]color.Color, error) {
+	if palette, ok := NamedPalettes[strings.ToLower(nameOrPath)]; ok {
+		return palette, nil
+	}
+
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a built-in palette (%s) nor a readable file: %w", nameOrPath, strings.Join(PaletteNames(), ", "), err)
+	}
+
+	var palette []color.Color
+	switch strings.ToLower(filepath.Ext(nameOrPath)) {
+	case ".gpl":
+		palette, err = parseGPL(string(data))
+	case ".json":
+		palette, err = parseLospecJSON(data)
+	default:
+		palette, err = parseHexLines(string(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading palette %s: %w", nameOrPath, err)
+	}
+	if len(palette) == 0 {
+		return nil, fmt.Errorf("palette %s has no colors", nameOrPath)
+	}
+	return palette, nil
+}
+
+// parseGPL reads a GIMP palette: a "GIMP Palette" header, optional Name/Columns lines,
+// '#' comments and one "R G B [name]" line per color.
+func parseGPL(data string) ([]color.Color, error) {
+	var palette []color.Color
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line == "GIMP Palette" || strings.HasPrefix(line, "Name:") || strings.HasPrefix(line, "Columns:") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected \"R G B\"", lineNumber)
+		}
+		var rgb [3]uint8
+		for i := range rgb {
+			v, err := strconv.ParseUint(fields[i], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			rgb[i] = uint8(v)
+		}
+		palette = append(palette, color.RGBA{rgb[0], rgb[1], rgb[2], 255})
+	}
+	return palette, scanner.Err()
+}
+
+// parseHexLines reads one hex color per line. paint.net's AARRGGBB entries and ';' comments are accepted too.
+func parseHexLines(data string) ([]color.Color, error) {
+	var palette []color.Color
+	for lineNumber, line := range strings.Split(data, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "#")
+		if line == "" || line[0] == ';' {
+			continue
+		}
+		if len(line) == 8 {
+			line = line[2:]
+		}
+		c, err := ParseHexColorFast("#" + line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid color %q", lineNumber+1, line)
+		}
+		palette = append(palette, c)
+	}
+	return palette, nil
+}
+
+func parseLospecJSON(data []byte) ([]color.Color, error) {
+	var lospec struct {
+		Colors []string `json:"colors"`
+	}
+	if err := json.Unmarshal(data, &lospec); err != nil {
+		return nil, err
+	}
+	return ParseHexColorList(strings.Join(lospec.Colors, ","))
+}
+
+// PaletteMatcher finds the perceptually closest palette entry of a color, comparing in OKLab.
+type PaletteMatcher struct {
+	colors []color.RGBA
+	labs   [][3]float64
+	cache  map[color.RGBA]int
+}
+
+func NewPaletteMatcher(palette []color.Color) *PaletteMatcher {
+	matcher := &PaletteMatcher{cache: map[color.RGBA]int{}}
+	for _, c := range palette {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		var lab [3]float64
+		lab[0], lab[1], lab[2] = RGBToOKLab(rgba)
+		matcher.colors = append(matcher.colors, rgba)
+		matcher.labs = append(matcher.labs, lab)
+	}
+	return matcher
+}
+
+// Nearest returns the index of the palette color closest to the opaque color c.
+func (m *PaletteMatcher) Nearest(c color.RGBA) int {
+	if index, ok := m.cache[c]; ok {
+		return index
+	}
+
+	L, a, b := RGBToOKLab(c)
+	best, bestDist := 0, math.Inf(1)
+	for i, lab := range m.labs {
+		dL, da, db := L-lab[0], a-lab[1], b-lab[2]
+		if dist := dL*dL + da*da + db*db; dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	m.cache[c] = best
+	return best
+}
+
+// Color returns the palette entry at index.
+func (m *PaletteMatcher) Color(index int) color.RGBA {
+	return m.colors[index]
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// rowsPerBand keeps bands large enough that scheduling them costs next to nothing.
+const rowsPerBand = 16
+
+var (
+	poolOnce sync.Once
+	poolJobs chan func()
+	workers  = runtime.NumCPU()
+)
+
+// SetWorkers sets how many goroutines ParallelRows spreads work over; 1 runs everything on the
+// calling goroutine. The pool is sized on first use, so raise it before processing any image.
+func SetWorkers(n int) {
+	workers = max(n, 1)
+}
+
+// Workers returns the number of goroutines ParallelRows uses.
+func Workers() int {
+	return workers
+}
+
+func startPool() {
+	poolJobs = make(chan func())
+	for i := 0; i < workers-1; i++ {
+		go func() {
+			for job := range poolJobs {
+				job()
+			}
+		}()
+	}
+}
+
+// ParallelRows splits the rows [0, height) into bands and calls fn for each band on the shared
+// worker pool, returning once all of them are done. fn must only write to its own rows.
+// The caller works on bands too, so calling ParallelRows from inside fn cannot deadlock.
+func ParallelRows(height int, fn func(y0, y1 int)) {
+	ParallelRowsContext(context.Background(), height, fn)
+}
+
+// ParallelRowsContext is ParallelRows for work that can be cancelled: once ctx is done, bands
+// that haven't started are skipped and ctx's error is returned. The rows are then incomplete.
+func ParallelRowsContext(ctx context.Context, height int, fn func(y0, y1 int)) error {
+	if workers <= 1 || height <= rowsPerBand {
+		// still go band by band, so a cancelled context is noticed before the end
+		for y0 := 0; y0 < height; y0 += rowsPerBand * 4 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fn(y0, min(y0+rowsPerBand*4, height))
+		}
+		return ctx.Err()
+	}
+	poolOnce.Do(startPool)
+
+	// a few bands per worker evens out rows that take longer than others
+	bandSize := max(rowsPerBand, (height+workers*4-1)/(workers*4))
+
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < height && ctx.Err() == nil; y0 += bandSize {
+		y1 := min(y0+bandSize, height)
+		wg.Add(1)
+		job := func() {
+			defer wg.Done()
+			if ctx.Err() == nil {
+				fn(y0, y1)
+			}
+		}
+		select {
+		case poolJobs <- job:
+		default:
+			// every worker is busy, so do the band here instead of waiting
+			job()
+		}
+	}
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNGStreamWriter encodes an 8-bit RGBA PNG whose rows arrive in order, a band at a time, so the
+// full image never has to be held in memory.
+type PNGStreamWriter struct {
+	w             io.Writer
+	width, height int
+	rowsWritten   int
+
+	idat *bufio.Writer
+	zw   *zlib.Writer
+	// current and previous unfiltered scanlines, and the filtered one prefixed with its filter type
+	row, prev, filtered []uint8
+}
+
+// chunkWriter writes everything it receives as one PNG chunk per Write call.
+type chunkWriter struct {
+	w         io.Writer
+	chunkType string
+}
+
+func (c chunkWriter) Write(data []byte) (int, error) {
+	if err := writePNGChunk(c.w, c.chunkType, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+	for _, part := range [][]byte{header[:], data, footer[:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPNGStreamWriter writes the PNG signature and header for a width x height image.
+func NewPNGStreamWriter(w io.Writer, width, height int) (*PNGStreamWriter, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid PNG size %dx%d", width, height)
+	}
+	if _, err := w.Write(pngSignature); err != nil {
+		return nil, err
+	}
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // truecolor with alpha
+	if err := writePNGChunk(w, "IHDR", ihdr[:]); err != nil {
+		return nil, err
+	}
+
+	// buffer the compressed stream so IDAT chunks come out at a sensible size
+	idat := bufio.NewWriterSize(chunkWriter{w, "IDAT"}, 1<<16)
+	return &PNGStreamWriter{
+		w:        w,
+		width:    width,
+		height:   height,
+		idat:     idat,
+		zw:       zlib.NewWriter(idat),
+		row:      make([]uint8, width*4),
+		prev:     make([]uint8, width*4),
+		filtered: make([]uint8, 1+width*4),
+	}, nil
+}
+
+// WriteText adds text metadata, see SaveImageWithText. It must be called before any rows are written.
+func (p *PNGStreamWriter) WriteText(text map[string]string) error {
+	if p.rowsWritten > 0 {
+		return errors.New("PNG text must be written before the image rows")
+	}
+	return writePNGText(p.w, text)
+}
+
+// WriteRows appends every row of img, which must be exactly as wide as the PNG.
+func (p *PNGStreamWriter) WriteRows(img *image.RGBA) error {
+	bounds := img.Bounds()
+	if bounds.Dx() != p.width {
+		return fmt.Errorf("band is %d pixels wide, PNG is %d", bounds.Dx(), p.width)
+	}
+	if p.rowsWritten+bounds.Dy() > p.height {
+		return errors.New("more rows written than the PNG is high")
+	}
+
+	for y := 0; y < bounds.Dy(); y++ {
+		p.row, p.prev = p.prev, p.row
+		// PNG stores straight alpha
+		pix := img.Pix[y*img.Stride : y*img.Stride+p.width*4]
+		raw := p.row
+		for i := 0; i < len(pix); i += 4 {
+			a := uint32(pix[i+3])
+			raw[i+3] = uint8(a)
+			switch a {
+			case 0:
+				raw[i], raw[i+1], raw[i+2] = 0, 0, 0
+			case 255:
+				raw[i], raw[i+1], raw[i+2] = pix[i], pix[i+1], pix[i+2]
+			default:
+				raw[i] = uint8(uint32(pix[i]) * 255 / a)
+				raw[i+1] = uint8(uint32(pix[i+1]) * 255 / a)
+				raw[i+2] = uint8(uint32(pix[i+2]) * 255 / a)
+			}
+		}
+
+		if err := p.writeFiltered(); err != nil {
+			return err
+		}
+		p.rowsWritten++
+	}
+	return nil
+}
+
+// writeFiltered compresses the current row with the Paeth filter, which suits both the flat
+// background and the glyph edges well. The unfiltered row is kept for the next one.
+func (p *PNGStreamWriter) writeFiltered() error {
+	raw, prev, filtered := p.row, p.prev, p.filtered
+	filtered[0] = 4
+	for i := range raw {
+		var left, upLeft uint8
+		if i >= 4 {
+			left, upLeft = raw[i-4], prev[i-4]
+		}
+		filtered[i+1] = raw[i] - paeth(left, prev[i], upLeft)
+	}
+	_, err := p.zw.Write(filtered)
+	return err
+}
+
+func paeth(a, b, c uint8) uint8 {
+	pc := int(c)
+	pa := int(b) - pc
+	pb := int(a) - pc
+	pcDist := pa + pb
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pcDist < 0 {
+		pcDist = -pcDist
+	}
+	if pa <= pb && pa <= pcDist {
+		return a
+	}
+	if pb <= pcDist {
+		return b
+	}
+	return c
+}
+
+// Close finishes the image data and writes the end of the PNG. All rows must have been written.
+func (p *PNGStreamWriter) Close() error {
+	if p.rowsWritten != p.height {
+		return fmt.Errorf("only %d of %d rows written", p.rowsWritten, p.height)
+	}
+	if err := p.zw.Close(); err != nil {
+		return err
+	}
+	if err := p.idat.Flush(); err != nil {
+		return err
+	}
+	return writePNGChunk(p.w, "IEND", nil)
+}
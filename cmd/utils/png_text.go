@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+)
+
+// pngHeaderSize is the length of the signature and the IHDR chunk, after which text chunks go.
+const pngHeaderSize = 8 + 4 + 4 + 13 + 4
+
+// pngTextChunk encodes a text entry as tEXt, or as iTXt if the value isn't plain ASCII.
+func pngTextChunk(key, value string) (string, []byte, error) {
+	if len(key) == 0 || len(key) > 79 || !isASCII(key) {
+		return "", nil, fmt.Errorf("invalid PNG text keyword %q", key)
+	}
+	var data bytes.Buffer
+	data.WriteString(key)
+	data.WriteByte(0)
+	if isASCII(value) {
+		data.WriteString(value)
+		return "tEXt", data.Bytes(), nil
+	}
+	// uncompressed, no language tag and no translated keyword
+	data.Write([]byte{0, 0, 0, 0})
+	data.WriteString(value)
+	return "iTXt", data.Bytes(), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 || s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// writePNGText writes one text chunk per entry, sorted by key.
+func writePNGText(w io.Writer, text map[string]string) error {
+	for _, key := range slices.Sorted(maps.Keys(text)) {
+		chunkType, data, err := pngTextChunk(key, text[key])
+		if err != nil {
+			return err
+		}
+		if err := writePNGChunk(w, chunkType, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// textInserter passes an encoded PNG through and slips the text chunks in right after the header.
+type textInserter struct {
+	w       io.Writer
+	text    map[string]string
+	written int
+}
+
+func (t *textInserter) Write(p []byte) (int, error) {
+	n := 0
+	if t.written < pngHeaderSize {
+		head := min(len(p), pngHeaderSize-t.written)
+		if _, err := t.w.Write(p[:head]); err != nil {
+			return 0, err
+		}
+		t.written += head
+		n = head
+		if t.written == pngHeaderSize {
+			if err := writePNGText(t.w, t.text); err != nil {
+				return n, err
+			}
+		}
+	}
+	m, err := t.w.Write(p[n:])
+	t.written += m
+	return n + m, err
+}
+
+// ReadPNGText returns the tEXt and iTXt entries of the PNG at path. Compressed entries are skipped.
+func ReadPNGText(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return nil, errors.New("not a PNG file")
+	}
+
+	text := map[string]string{}
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, fmt.Errorf("truncated PNG: %w", err)
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+		if chunkType == "IEND" {
+			return text, nil
+		}
+		if chunkType != "tEXt" && chunkType != "iTXt" {
+			// skip the data and the CRC
+			if _, err := io.CopyN(io.Discard, r, length+4); err != nil {
+				return nil, fmt.Errorf("truncated PNG: %w", err)
+			}
+			continue
+		}
+
+		body := make([]byte, length+4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("truncated PNG: %w", err)
+		}
+		if key, value, ok := parsePNGText(chunkType, body[:length]); ok {
+			text[key] = value
+		}
+	}
+}
+
+func parsePNGText(chunkType string, body []byte) (string, string, bool) {
+	key, rest, ok := bytes.Cut(body, []byte{0})
+	if !ok {
+		return "", "", false
+	}
+	if chunkType == "tEXt" {
+		return string(key), string(rest), true
+	}
+	if len(rest) < 2 || rest[0] != 0 {
+		return "", "", false
+	}
+	// skip the compression method, language tag and translated keyword
+	_, rest, ok = bytes.Cut(rest[2:], []byte{0})
+	if !ok {
+		return "", "", false
+	}
+	_, value, ok := bytes.Cut(rest, []byte{0})
+	return string(key), string(value), ok
+}
@@ -4,17 +4,12 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"image"
 	"image/color"
 )
 
-// blurStack is a linked list containing the color value and a pointer to the next struct.
-type blurStack struct {
-	r, g, b, a uint32
-	next       *blurStack
-}
-
 var mulTable = []uint32{
 	512, 512, 456, 512, 328, 456, 335, 512, 405, 328, 271, 456, 388, 335, 292, 512,
 	454, 405, 364, 328, 298, 271, 496, 456, 420, 388, 360, 335, 312, 292, 273, 512,
@@ -54,22 +49,9 @@ var shgTable = []uint32{
 }
 
 // Process takes the source image and returns it's blurred version by applying the blur radius defined as parameter.
-func StackBlur(src image.Image, radius uint32) (*image.NRGBA, error) {
-	var (
-		stackEnd *blurStack
-		stackIn  *blurStack
-		stackOut *blurStack
-	)
-
-	var width, height = uint32(src.Bounds().Dx()), uint32(src.Bounds().Dy())
-	var (
-		div, widthMinus1, heightMinus1, radiusPlus1, sumFactor uint32
-		x, y, i, p, yp, yi, yw,
-		rSum, gSum, bSum, aSum,
-		rOutSum, gOutSum, bOutSum, aOutSum,
-		rInSum, gInSum, bInSum, aInSum,
-		pr, pg, pb, pa uint32
-	)
+// Rows and then columns are blurred in parallel; src itself is left untouched. It stops early
+// with ctx's error once ctx is done.
+func StackBlur(ctx context.Context, src image.Image, radius uint32) (*image.NRGBA, error) {
 	// Limit the maximum blur radius to 255, otherwise it overflows the multable length
 	// and will panic with and index out of range error.
 	if int(radius) >= len(mulTable) {
@@ -81,293 +63,101 @@ func StackBlur(src image.Image, radius uint32) (*image.NRGBA, error) {
 	}
 
 	img := toNRGBA(src)
-
-	div = radius + radius + 1
-	widthMinus1 = width - 1
-	heightMinus1 = height - 1
-	radiusPlus1 = radius + 1
-	sumFactor = radiusPlus1 * (radiusPlus1 + 1) / 2
-
-	stackStart := new(blurStack)
-	stack := stackStart
-
-	for i = 1; i < div; i++ {
-		stack.next = new(blurStack)
-		stack = stack.next
-		if i == radiusPlus1 {
-			stackEnd = stack
-		}
+	if img == src {
+		img = &image.NRGBA{Pix: append([]uint8(nil), img.Pix...), Stride: img.Stride, Rect: img.Rect}
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width == 0 || height == 0 {
+		return img, nil
 	}
-	stack.next = stackStart
-
-	mulSum := mulTable[radius]
-	shgSum := shgTable[radius]
-
-	for y = 0; y < height; y++ {
-		rInSum, gInSum, bInSum, aInSum, rSum, gSum, bSum, aSum = 0, 0, 0, 0, 0, 0, 0, 0
-
-		pr = uint32(img.Pix[yi])
-		pg = uint32(img.Pix[yi+1])
-		pb = uint32(img.Pix[yi+2])
-		pa = uint32(img.Pix[yi+3])
-
-		rOutSum = radiusPlus1 * pr
-		gOutSum = radiusPlus1 * pg
-		bOutSum = radiusPlus1 * pb
-		aOutSum = radiusPlus1 * pa
-
-		rSum += sumFactor * pr
-		gSum += sumFactor * pg
-		bSum += sumFactor * pb
-		aSum += sumFactor * pa
-
-		stack = stackStart
 
-		for i = 0; i < radiusPlus1; i++ {
-			stack.r = pr
-			stack.g = pg
-			stack.b = pb
-			stack.a = pa
-			stack = stack.next
+	err := ParallelRowsContext(ctx, height, func(y0, y1 int) {
+		stack := make([][4]uint32, 2*radius+1)
+		for y := y0; y < y1; y++ {
+			stackBlurLine(img.Pix, y*img.Stride, 4, width, radius, stack)
 		}
-
-		for i = 1; i < radiusPlus1; i++ {
-			var diff uint32
-			if widthMinus1 < i {
-				diff = widthMinus1
-			} else {
-				diff = i
-			}
-			p = yi + (diff << 2)
-			pr = uint32(img.Pix[p])
-			pg = uint32(img.Pix[p+1])
-			pb = uint32(img.Pix[p+2])
-			pa = uint32(img.Pix[p+3])
-
-			stack.r = pr
-			stack.g = pg
-			stack.b = pb
-			stack.a = pa
-
-			rSum += stack.r * (radiusPlus1 - i)
-			gSum += stack.g * (radiusPlus1 - i)
-			bSum += stack.b * (radiusPlus1 - i)
-			aSum += stack.a * (radiusPlus1 - i)
-
-			rInSum += pr
-			gInSum += pg
-			bInSum += pb
-			aInSum += pa
-
-			stack = stack.next
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the columns are independent too, so they're split into bands the same way
+	err = ParallelRowsContext(ctx, width, func(x0, x1 int) {
+		stack := make([][4]uint32, 2*radius+1)
+		for x := x0; x < x1; x++ {
+			stackBlurLine(img.Pix, x*4, img.Stride, height, radius, stack)
 		}
-		stackIn = stackStart
-		stackOut = stackEnd
-
-		for x = 0; x < width; x++ {
-			pa = (aSum * mulSum) >> shgSum
-			img.Pix[yi+3] = uint8(pa)
-
-			if pa != 0 {
-				img.Pix[yi] = uint8((rSum * mulSum) >> shgSum)
-				img.Pix[yi+1] = uint8((gSum * mulSum) >> shgSum)
-				img.Pix[yi+2] = uint8((bSum * mulSum) >> shgSum)
-			} else {
-				img.Pix[yi] = 0
-				img.Pix[yi+1] = 0
-				img.Pix[yi+2] = 0
-			}
-
-			rSum -= rOutSum
-			gSum -= gOutSum
-			bSum -= bOutSum
-			aSum -= aOutSum
-
-			rOutSum -= stackIn.r
-			gOutSum -= stackIn.g
-			bOutSum -= stackIn.b
-			aOutSum -= stackIn.a
-
-			p = x + radius + 1
-
-			if p > widthMinus1 {
-				p = widthMinus1
-			}
-			p = (yw + p) << 2
-
-			stackIn.r = uint32(img.Pix[p])
-			stackIn.g = uint32(img.Pix[p+1])
-			stackIn.b = uint32(img.Pix[p+2])
-			stackIn.a = uint32(img.Pix[p+3])
-
-			rInSum += stackIn.r
-			gInSum += stackIn.g
-			bInSum += stackIn.b
-			aInSum += stackIn.a
-
-			rSum += rInSum
-			gSum += gInSum
-			bSum += bInSum
-			aSum += aInSum
-
-			stackIn = stackIn.next
-
-			pr = stackOut.r
-			pg = stackOut.g
-			pb = stackOut.b
-			pa = stackOut.a
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
 
-			rOutSum += pr
-			gOutSum += pg
-			bOutSum += pb
-			aOutSum += pa
+// stackBlurLine blurs length pixels in place, starting at Pix offset start and stride bytes apart.
+// stack is scratch space of 2*radius+1 entries, used as a ring.
+func stackBlurLine(pix []uint8, start, stride, length int, radius uint32, stack [][4]uint32) {
+	var sum, inSum, outSum [4]uint32
 
-			rInSum -= pr
-			gInSum -= pg
-			bInSum -= pb
-			aInSum -= pa
+	div := len(stack)
+	radiusPlus1 := radius + 1
+	sumFactor := radiusPlus1 * (radiusPlus1 + 1) / 2
+	mulSum := mulTable[radius]
+	shgSum := shgTable[radius]
+	last := length - 1
 
-			stackOut = stackOut.next
+	pixel := func(i int) [4]uint32 {
+		p := start + min(i, last)*stride
+		return [4]uint32{uint32(pix[p]), uint32(pix[p+1]), uint32(pix[p+2]), uint32(pix[p+3])}
+	}
 
-			yi += 4
+	first := pixel(0)
+	for c := 0; c < 4; c++ {
+		outSum[c] = radiusPlus1 * first[c]
+		sum[c] = sumFactor * first[c]
+	}
+	for i := uint32(0); i < radiusPlus1; i++ {
+		stack[i] = first
+	}
+	for i := uint32(1); i <= radius; i++ {
+		p := pixel(int(i))
+		stack[radius+i] = p
+		for c := 0; c < 4; c++ {
+			sum[c] += p[c] * (radiusPlus1 - i)
+			inSum[c] += p[c]
 		}
-		yw += width
 	}
 
-	for x = 0; x < width; x++ {
-		rInSum, gInSum, bInSum, aInSum, rSum, gSum, bSum, aSum = 0, 0, 0, 0, 0, 0, 0, 0
-
-		yi = x << 2
-		pr = uint32(img.Pix[yi])
-		pg = uint32(img.Pix[yi+1])
-		pb = uint32(img.Pix[yi+2])
-		pa = uint32(img.Pix[yi+3])
-
-		rOutSum = radiusPlus1 * pr
-		gOutSum = radiusPlus1 * pg
-		bOutSum = radiusPlus1 * pb
-		aOutSum = radiusPlus1 * pa
-
-		rSum += sumFactor * pr
-		gSum += sumFactor * pg
-		bSum += sumFactor * pb
-		aSum += sumFactor * pa
-
-		stack = stackStart
-
-		for i = 0; i < radiusPlus1; i++ {
-			stack.r = pr
-			stack.g = pg
-			stack.b = pb
-			stack.a = pa
-			stack = stack.next
+	stackIn, stackOut := 0, int(radiusPlus1)
+	for i := 0; i < length; i++ {
+		p := start + i*stride
+		alpha := (sum[3] * mulSum) >> shgSum
+		pix[p+3] = uint8(alpha)
+		if alpha != 0 {
+			pix[p] = uint8((sum[0] * mulSum) >> shgSum)
+			pix[p+1] = uint8((sum[1] * mulSum) >> shgSum)
+			pix[p+2] = uint8((sum[2] * mulSum) >> shgSum)
+		} else {
+			pix[p], pix[p+1], pix[p+2] = 0, 0, 0
 		}
 
-		yp = width
-
-		for i = 1; i <= radius; i++ {
-			yi = (yp + x) << 2
-			pr = uint32(img.Pix[yi])
-			pg = uint32(img.Pix[yi+1])
-			pb = uint32(img.Pix[yi+2])
-			pa = uint32(img.Pix[yi+3])
-
-			stack.r = pr
-			stack.g = pg
-			stack.b = pb
-			stack.a = pa
-
-			rSum += stack.r * (radiusPlus1 - i)
-			gSum += stack.g * (radiusPlus1 - i)
-			bSum += stack.b * (radiusPlus1 - i)
-			aSum += stack.a * (radiusPlus1 - i)
-
-			rInSum += pr
-			gInSum += pg
-			bInSum += pb
-			aInSum += pa
-
-			stack = stack.next
-
-			if i < heightMinus1 {
-				yp += width
-			}
+		// pixels ahead of i haven't been written yet, so the line can be blurred in place
+		next := pixel(i + int(radiusPlus1))
+		for c := 0; c < 4; c++ {
+			sum[c] -= outSum[c]
+			outSum[c] -= stack[stackIn][c]
+			inSum[c] += next[c]
+			sum[c] += inSum[c]
 		}
+		stack[stackIn] = next
+		stackIn = (stackIn + 1) % div
 
-		yi = x
-		stackIn = stackStart
-		stackOut = stackEnd
-
-		for y = 0; y < height; y++ {
-			p = yi << 2
-			pa = (aSum * mulSum) >> shgSum
-			img.Pix[p+3] = uint8(pa)
-
-			if pa > 0 {
-				img.Pix[p] = uint8((rSum * mulSum) >> shgSum)
-				img.Pix[p+1] = uint8((gSum * mulSum) >> shgSum)
-				img.Pix[p+2] = uint8((bSum * mulSum) >> shgSum)
-			} else {
-				img.Pix[p] = 0
-				img.Pix[p+1] = 0
-				img.Pix[p+2] = 0
-			}
-
-			rSum -= rOutSum
-			gSum -= gOutSum
-			bSum -= bOutSum
-			aSum -= aOutSum
-
-			rOutSum -= stackIn.r
-			gOutSum -= stackIn.g
-			bOutSum -= stackIn.b
-			aOutSum -= stackIn.a
-
-			p = y + radiusPlus1
-
-			if p > heightMinus1 {
-				p = heightMinus1
-			}
-			p = (x + (p * width)) << 2
-
-			stackIn.r = uint32(img.Pix[p])
-			stackIn.g = uint32(img.Pix[p+1])
-			stackIn.b = uint32(img.Pix[p+2])
-			stackIn.a = uint32(img.Pix[p+3])
-
-			rInSum += stackIn.r
-			gInSum += stackIn.g
-			bInSum += stackIn.b
-			aInSum += stackIn.a
-
-			rSum += rInSum
-			gSum += gInSum
-			bSum += bInSum
-			aSum += aInSum
-
-			stackIn = stackIn.next
-
-			pr = stackOut.r
-			pg = stackOut.g
-			pb = stackOut.b
-			pa = stackOut.a
-
-			rOutSum += pr
-			gOutSum += pg
-			bOutSum += pb
-			aOutSum += pa
-
-			rInSum -= pr
-			gInSum -= pg
-			bInSum -= pb
-			aInSum -= pa
-
-			stackOut = stackOut.next
-
-			yi += width
+		out := stack[stackOut]
+		for c := 0; c < 4; c++ {
+			outSum[c] += out[c]
+			inSum[c] -= out[c]
 		}
+		stackOut = (stackOut + 1) % div
 	}
-	return img, nil
 }
 
 // toNRGBA converts an image type to *image.NRGBA with min-point at (0, 0).
@@ -392,10 +182,27 @@ func toNRGBA(img image.Image) *image.NRGBA {
 		for dstY := 0; dstY < dstH; dstY++ {
 			di := dst.PixOffset(0, dstY)
 			si := src.PixOffset(srcMinX, srcMinY+dstY)
-			for dstX := 0; dstX < dstW; dstX++ {
-				copy(dst.Pix[di:di+rowSize], src.Pix[si:si+rowSize])
-			}
+			copy(dst.Pix[di:di+rowSize], src.Pix[si:si+rowSize])
 		}
+	case *image.RGBA:
+		ParallelRows(dstH, func(y0, y1 int) {
+			for dstY := y0; dstY < y1; dstY++ {
+				di := dst.PixOffset(0, dstY)
+				si := src.PixOffset(srcMinX, srcMinY+dstY)
+				for dstX := 0; dstX < dstW; dstX++ {
+					// rounds like color.NRGBAModel, which works on 16-bit channels
+					a := uint32(src.Pix[si+3])
+					dst.Pix[di+3] = uint8(a)
+					if a != 0 {
+						dst.Pix[di+0] = uint8(uint32(src.Pix[si+0]) * 0xffff / a >> 8)
+						dst.Pix[di+1] = uint8(uint32(src.Pix[si+1]) * 0xffff / a >> 8)
+						dst.Pix[di+2] = uint8(uint32(src.Pix[si+2]) * 0xffff / a >> 8)
+					}
+					di += 4
+					si += 4
+				}
+			}
+		})
 	case *image.YCbCr:
 		for dstY := 0; dstY < dstH; dstY++ {
 			di := dst.PixOffset(0, dstY)
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"asciify/cmd/internal/testimage"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"testing"
+)
+
+// testSizes are odd sizes around the band height, down to single rows and columns.
+var testSizes = []image.Point{{1, 1}, {1, 9}, {9, 1}, {3, 7}, {17, 15}, {67, 33}, {131, 77}}
+
+// testImages returns opaque and translucent cards of every test size, plus a sub-image whose
+// bounds don't start at the origin.
+func testImages() map[string]image.Image {
+	images := map[string]image.Image{}
+	for _, size := range testSizes {
+		images[fmt.Sprintf("opaque %dx%d", size.X, size.Y)] = testimage.Card(size.X, size.Y)
+		images[fmt.Sprintf("translucent %dx%d", size.X, size.Y)] = testimage.TranslucentCard(size.X, size.Y)
+	}
+	images["sub-image"] = testimage.TranslucentCard(150, 90).SubImage(image.Rect(13, 7, 140, 80))
+	return images
+}
+
+// withWorkers runs test once on the calling goroutine alone and once split over the worker pool.
+func withWorkers(t *testing.T, test func(t *testing.T)) {
+	defer SetWorkers(Workers())
+	for _, n := range []int{1, 4} {
+		SetWorkers(n)
+		t.Run(fmt.Sprintf("%d workers", n), test)
+	}
+}
+
+// referenceStackBlur convolves every row and then every column with the triangle kernel StackBlur
+// approximates, clamping at the borders and dividing the way StackBlur does.
+func referenceStackBlur(src image.Image, radius uint32) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Rect, src, src.Bounds().Min, draw.Src)
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	r := int(radius)
+
+	blurLine := func(start, stride, length int) {
+		line := make([]uint8, length*4)
+		for i := 0; i < length; i++ {
+			copy(line[i*4:i*4+4], img.Pix[start+i*stride:])
+		}
+		for i := 0; i < length; i++ {
+			var sum [4]uint32
+			for k := -r; k <= r; k++ {
+				p := min(max(i+k, 0), length-1) * 4
+				weight := uint32(r + 1 - max(k, -k))
+				for c := 0; c < 4; c++ {
+					sum[c] += uint32(line[p+c]) * weight
+				}
+			}
+			out := img.Pix[start+i*stride:]
+			out[3] = uint8((sum[3] * mulTable[radius]) >> shgTable[radius])
+			for c := 0; c < 3; c++ {
+				if out[3] != 0 {
+					out[c] = uint8((sum[c] * mulTable[radius]) >> shgTable[radius])
+				} else {
+					out[c] = 0
+				}
+			}
+		}
+	}
+	for y := 0; y < height; y++ {
+		blurLine(y*img.Stride, 4, width)
+	}
+	for x := 0; x < width; x++ {
+		blurLine(x*4, img.Stride, height)
+	}
+	return img
+}
+
+func TestStackBlur(t *testing.T) {
+	withWorkers(t, func(t *testing.T) {
+		for name, img := range testImages() {
+			for _, radius := range []uint32{1, 3, 6, 40} {
+				t.Run(fmt.Sprintf("%s r%d", name, radius), func(t *testing.T) {
+					got, err := StackBlur(context.Background(), img, radius)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want := referenceStackBlur(img, radius)
+					if got.Rect != want.Rect {
+						t.Fatalf("bounds %v, want %v", got.Rect, want.Rect)
+					}
+					for y := 0; y < want.Rect.Dy(); y++ {
+						for x := 0; x < want.Rect.Dx(); x++ {
+							if g, w := got.NRGBAAt(x, y), want.NRGBAAt(x, y); g != w {
+								t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, g, w)
+							}
+						}
+					}
+				})
+			}
+		}
+	})
+}
+
+func TestStackBlurLeavesSourceAlone(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(src, src.Rect, testimage.TranslucentCard(20, 20), image.Point{}, draw.Src)
+	before := append([]uint8(nil), src.Pix...)
+	if _, err := StackBlur(context.Background(), src, 4); err != nil {
+		t.Fatal(err)
+	}
+	if string(src.Pix) != string(before) {
+		t.Error("StackBlur modified its source")
+	}
+}
+
+func TestStackBlurCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := StackBlur(ctx, testimage.Card(200, 200), 4); err != context.Canceled {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+}
@@ -2,8 +2,10 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"image/color"
 	"math"
+	"strings"
 )
 
 var asciiMap = []rune{' ', '.', '>', '+', 'o', 'P', '0', '?', '#', '@'}
@@ -27,21 +29,87 @@ func LuminanceToBrightness(lum float64) float64 {
 	}
 }
 
+// GetTrueLuminance picks the ramp character for c's perceptual lightness.
 func GetTrueLuminance(c color.Color) rune {
-	r, g, b, _ := c.RGBA()
-	// fmt.Println("r", r, "g", g, "b", b)
-	const divisor_factor float64 = 65535.0
-	vR, vG, vB := float64(r)/divisor_factor, float64(g)/divisor_factor, float64(b)/divisor_factor
-	// fmt.Println("vR", vR, "vG", vG, "vB", vB)
+	return LuminancePerceptual.Character(c)
+}
 
-	luminance := (0.2126*SRGBToLin(vR) + 0.7152*SRGBToLin(vG) + 0.0722*SRGBToLin(vB))
-	brightness := LuminanceToBrightness(luminance)
+// LuminanceModel decides how a color is reduced to a single brightness value.
+type LuminanceModel string
 
-	// fmt.Println("brightness", brightness)
+const (
+	// L* lightness of the linearized color, spaced evenly to the eye
+	LuminancePerceptual LuminanceModel = "perceptual"
+	// physical relative luminance Y of the linearized color
+	LuminanceLinear LuminanceModel = "linear"
+	// BT.601 weights on the gamma-encoded color (classic "luma")
+	LuminanceRec601 LuminanceModel = "rec601"
+	// BT.709 weights on the gamma-encoded color, what GetLuminance uses
+	LuminanceRec709 LuminanceModel = "rec709"
+)
 
-	// since brightness is a value between 0 and 100, we need to map the luminance to the asciiMap
-	asciiIndex := uint(brightness / 100 * float64(len(asciiMap)-1))
+func ParseLuminanceModel(s string) (LuminanceModel, error) {
+	switch model := LuminanceModel(s); model {
+	case LuminancePerceptual, LuminanceLinear, LuminanceRec601, LuminanceRec709:
+		return model, nil
+	case "":
+		return LuminanceRec709, nil
+	}
+	return "", fmt.Errorf("unknown luminance model %q", s)
+}
 
+// Luminance returns the brightness of c between 0.0 and 1.0.
+// The zero value of LuminanceModel behaves like LuminanceRec709.
+// Partially transparent colors are un-premultiplied first, so alpha doesn't darken them.
+func (m LuminanceModel) Luminance(c color.Color) float64 {
+	r, g, b, a := c.RGBA()
+	if a == 0 {
+		return 0
+	}
+	return m.luminance(float64(r)/float64(a), float64(g)/float64(a), float64(b)/float64(a))
+}
+
+// srgbToLinLUT holds SRGBToLin for every 8-bit channel value.
+var srgbToLinLUT = func() (lut [256]float64) {
+	for i := range lut {
+		lut[i] = SRGBToLin(float64(i) / 255)
+	}
+	return lut
+}()
+
+// LuminanceRGBA is Luminance for the premultiplied channels of an *image.RGBA pixel. It avoids
+// boxing the color, and opaque pixels linearize through a lookup table.
+func (m LuminanceModel) LuminanceRGBA(r, g, b, a uint8) float64 {
+	if a == 0 {
+		return 0
+	}
+	if a == 255 && (m == LuminancePerceptual || m == LuminanceLinear) {
+		return m.fromLinear(0.2126*srgbToLinLUT[r] + 0.7152*srgbToLinLUT[g] + 0.0722*srgbToLinLUT[b])
+	}
+	return m.luminance(float64(r)/float64(a), float64(g)/float64(a), float64(b)/float64(a))
+}
+
+// luminance works on un-premultiplied channels between 0 and 1.
+func (m LuminanceModel) luminance(vR, vG, vB float64) float64 {
+	switch m {
+	case LuminancePerceptual, LuminanceLinear:
+		return m.fromLinear(0.2126*SRGBToLin(vR) + 0.7152*SRGBToLin(vG) + 0.0722*SRGBToLin(vB))
+	case LuminanceRec601:
+		return 0.299*vR + 0.587*vG + 0.114*vB
+	}
+	return 0.2126*vR + 0.7152*vG + 0.0722*vB
+}
+
+func (m LuminanceModel) fromLinear(y float64) float64 {
+	if m == LuminancePerceptual {
+		return Clamp(LuminanceToBrightness(y)/100, 0, 1)
+	}
+	return y
+}
+
+// Character maps c onto the ASCII ramp using the model's brightness.
+func (m LuminanceModel) Character(c color.Color) rune {
+	asciiIndex := uint(m.Luminance(c) * float64(len(asciiMap)-1))
 	return asciiMap[asciiIndex]
 }
 
@@ -60,13 +128,30 @@ func GetLuminanceCharacter(c color.Color) rune {
 	return asciiMap[asciiIndex]
 }
 
+// AsciiRampSize is the number of glyphs luminance can be quantized to.
+func AsciiRampSize() int {
+	return len(asciiMap)
+}
+
+// GetRampCharacter returns the glyph for an already quantized luminance level.
+func GetRampCharacter(level int) rune {
+	return asciiMap[level]
+}
+
+// WithAlpha scales an opaque color by alpha, giving the premultiplied color.RGBA.
+func WithAlpha(c color.Color, alpha uint8) color.RGBA {
+	r, g, b, _ := c.RGBA()
+	a := uint32(alpha)
+	return color.RGBA{uint8((r >> 8) * a / 255), uint8((g >> 8) * a / 255), uint8((b >> 8) * a / 255), alpha}
+}
+
 // code from https://stackoverflow.com/questions/54197913/parse-hex-string-to-image-color
 var errInvalidFormat = errors.New("invalid format")
 
 func ParseHexColorFast(s string) (c color.RGBA, err error) {
 	c.A = 0xff
 
-	if s[0] != '#' {
+	if len(s) == 0 || s[0] != '#' {
 		return c, errInvalidFormat
 	}
 
@@ -158,3 +243,62 @@ func HSVToRGB(h, s, v float64) (uint8, uint8, uint8) {
 	bOut := uint8((b + m) * 255)
 	return rOut, gOut, bOut
 }
+
+// OKLab is Björn Ottosson's perceptual color space; interpolating in it gives even,
+// hue-stable gradients. https://bottosson.github.io/posts/oklab/
+func RGBToOKLab(c color.Color) (float64, float64, float64) {
+	r, g, b, _ := c.RGBA()
+	lr, lg, lb := SRGBToLin(float64(r)/65535.0), SRGBToLin(float64(g)/65535.0), SRGBToLin(float64(b)/65535.0)
+
+	l := math.Cbrt(0.4122214708*lr + 0.5363325363*lg + 0.0514459929*lb)
+	m := math.Cbrt(0.2119034982*lr + 0.6806995451*lg + 0.1073969566*lb)
+	s := math.Cbrt(0.0883024619*lr + 0.2817188376*lg + 0.6299787005*lb)
+
+	return 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		0.0259040371*l + 0.7827717662*m - 0.8086757660*s
+}
+
+func OKLabToRGB(L, a, b float64) color.RGBA {
+	l := L + 0.3963377774*a + 0.2158037573*b
+	m := L - 0.1055613458*a - 0.0638541728*b
+	s := L - 0.0894841775*a - 1.2914855480*b
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	lr := 4.0767416621*l - 3.3077115913*m + 0.2309699292*s
+	lg := -1.2684380046*l + 2.6097574011*m - 0.3413193965*s
+	lb := -0.0041960863*l - 0.7034186147*m + 1.7076147010*s
+
+	return color.RGBA{linToSRGB8(lr), linToSRGB8(lg), linToSRGB8(lb), 255}
+}
+
+func LinToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func linToSRGB8(v float64) uint8 {
+	return uint8(math.Round(Clamp(LinToSRGB(Clamp(v, 0, 1)), 0, 1) * 255))
+}
+
+// ParseHexColorList parses a comma separated list of hex colors, with or without the leading '#'.
+func ParseHexColorList(s string) ([]color.Color, error) {
+	var colors []color.Color
+	for _, hex := range strings.Split(s, ",") {
+		hex = strings.TrimSpace(hex)
+		if hex == "" {
+			continue
+		}
+		if hex[0] != '#' {
+			hex = "#" + hex
+		}
+		c, err := ParseHexColorFast(hex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid color %q: %w", hex, err)
+		}
+		colors = append(colors, c)
+	}
+	return colors, nil
+}
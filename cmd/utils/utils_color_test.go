@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestLuminanceRGBA(t *testing.T) {
+	models := []LuminanceModel{LuminancePerceptual, LuminanceLinear, LuminanceRec601, LuminanceRec709}
+	for _, model := range models {
+		for a := 0; a < 256; a += 15 {
+			for v := 0; v < 256; v += 5 {
+				// premultiplied channels can't exceed alpha
+				r, g, b := uint8(min(v, a)), uint8(min(255-v, a)), uint8(min(v/2, a))
+				got := model.LuminanceRGBA(r, g, b, uint8(a))
+				want := model.Luminance(color.RGBA{r, g, b, uint8(a)})
+				if got != want {
+					t.Fatalf("%s of %v: %v, want %v", model, color.RGBA{r, g, b, uint8(a)}, got, want)
+				}
+			}
+		}
+	}
+}
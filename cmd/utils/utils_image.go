@@ -3,11 +3,15 @@ package utils
 import (
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/nfnt/resize"
 )
@@ -19,85 +23,138 @@ func DownscaleImage(img image.Image, scale int) (int, int, image.Image) {
 	width /= scale
 	height /= scale
 
-	downscaled := resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
-
-	return width, height, downscaled
+	return width, height, ResizeImage(img, width, height)
 }
 
-func BoundImageToScaleMultiple(img image.Image, scalingFactor int) image.Image {
-	// compute the maximum size of the bounded image
-	width := img.Bounds().Dx()
-	height := img.Bounds().Dy()
-	fmt.Println("The current size of the image is: ", width, height)
+// ResizeImage resamples img with a Lanczos filter, premultiplying alpha so transparent pixels
+// don't bleed their stored color into their neighbors.
+func ResizeImage(img image.Image, width, height int) image.Image {
+	resized := resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+
+	// Lanczos overshoots around hard edges, which can push a channel above its alpha
+	// and break the premultiplied invariant.
+	switch resized := resized.(type) {
+	case *image.RGBA:
+		for i := 0; i < len(resized.Pix); i += 4 {
+			a := resized.Pix[i+3]
+			resized.Pix[i] = min(resized.Pix[i], a)
+			resized.Pix[i+1] = min(resized.Pix[i+1], a)
+			resized.Pix[i+2] = min(resized.Pix[i+2], a)
+		}
+	case *image.RGBA64:
+		for y := resized.Rect.Min.Y; y < resized.Rect.Max.Y; y++ {
+			for x := resized.Rect.Min.X; x < resized.Rect.Max.X; x++ {
+				c := resized.RGBA64At(x, y)
+				c.R, c.G, c.B = min(c.R, c.A), min(c.G, c.A), min(c.B, c.A)
+				resized.SetRGBA64(x, y, c)
+			}
+		}
+	}
 
-	reboundedImageWidth := width / scalingFactor * scalingFactor
-	reboundedImageHeight := height / scalingFactor * scalingFactor
-	fmt.Println("The post-processed size of the image is: ", reboundedImageWidth, reboundedImageHeight)
-	reboundedImage := image.NewRGBA(image.Rect(0, 0, reboundedImageWidth, reboundedImageHeight))
+	return resized
+}
 
-	widthDiff := width - reboundedImageWidth
-	heightDiff := height - reboundedImageHeight
-	if widthDiff == 0 && heightDiff == 0 {
-		return img
+// ToRGBA returns img as an *image.RGBA, converting it only if it isn't one already, so stages can
+// work on its Pix slice directly. The result must not be modified.
+func ToRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
 	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
 
-	startOffset_W := widthDiff / 2
-	endOffset_W := widthDiff - startOffset_W
+// rowPix returns the pixels of row y, counted from the top of img.
+func rowPix(img *image.RGBA, y int) []uint8 {
+	start := y * img.Stride
+	return img.Pix[start : start+img.Rect.Dx()*4]
+}
 
-	startOffset_H := heightDiff / 2
-	endOffset_H := heightDiff - startOffset_H
+// FlattenAlpha composites img over a solid background, removing any transparency.
+func FlattenAlpha(img image.Image, background color.Color) image.Image {
+	flattened := image.NewRGBA(img.Bounds())
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flattened
+}
 
-	for y := startOffset_H; y < reboundedImage.Bounds().Dy()-endOffset_H; y++ {
-		for x := startOffset_W; x < reboundedImage.Bounds().Dx()-endOffset_W; x++ {
-			reboundedImage.Set(x, y, img.At(x, y))
-		}
+// ScaleMultipleBounds returns the largest rectangle centered in bounds whose size is a multiple
+// of scalingFactor in both directions.
+func ScaleMultipleBounds(bounds image.Rectangle, scalingFactor int) image.Rectangle {
+	widthDiff := bounds.Dx() % scalingFactor
+	heightDiff := bounds.Dy() % scalingFactor
+	return image.Rect(
+		bounds.Min.X+widthDiff/2, bounds.Min.Y+heightDiff/2,
+		bounds.Max.X-(widthDiff-widthDiff/2), bounds.Max.Y-(heightDiff-heightDiff/2),
+	)
+}
+
+// BoundImageToScaleMultiple crops img to ScaleMultipleBounds, moved to the origin.
+func BoundImageToScaleMultiple(img image.Image, scalingFactor int) image.Image {
+	crop := ScaleMultipleBounds(img.Bounds(), scalingFactor)
+	if crop == img.Bounds() {
+		return img
 	}
+	reboundedImage := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(reboundedImage, reboundedImage.Bounds(), img, crop.Min, draw.Src)
 	return reboundedImage
 }
 
 func SaveImage(img image.Image, filename string) {
-	output_file, err := os.Create(filename)
-	if err != nil {
-		fmt.Println("Error creating output file: ", err)
+	if err := SaveImageWithText(img, filename, nil); err != nil {
+		fmt.Println("Error saving image: ", err)
 		log.Fatal(err)
 	}
-	defer output_file.Close()
+	fmt.Println("Image saved successfully.")
+}
+
+// SaveImageWithText saves img as a PNG with a text chunk for every entry of text, placed right
+// after the header so readers find them without decoding the image. Plain ASCII values are
+// stored as tEXt, anything else as UTF-8 iTXt.
+func SaveImageWithText(img image.Image, filename string, text map[string]string) error {
+	outputFile, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	defer outputFile.Close()
 
-	if err := png.Encode(output_file, img); err != nil {
-		fmt.Println("Error encoding image: ", err)
-		log.Fatal(err)
+	if err := EncodePNGWithText(outputFile, img, text); err != nil {
+		return err
 	}
-	fmt.Println("Image saved successfully.")
+	return outputFile.Close()
+}
+
+// EncodePNGWithText writes img to w as a PNG with the text chunks SaveImageWithText adds.
+func EncodePNGWithText(w io.Writer, img image.Image, text map[string]string) error {
+	if len(text) > 0 {
+		w = &textInserter{w: w, text: text}
+	}
+	if err := png.Encode(w, img); err != nil {
+		return fmt.Errorf("error encoding image: %w", err)
+	}
+	return nil
 }
 
-func LoadImage(imagePath string) image.Image {
+// LoadImage decodes the PNG or JPEG file at imagePath.
+func LoadImage(imagePath string) (image.Image, error) {
 	file, err := os.Open(imagePath)
 	if err != nil {
-		fmt.Println("Error opening file: ", err)
-		log.Fatal(err)
+		return nil, fmt.Errorf("error opening file: %w", err)
 	}
 	defer file.Close()
 
-	// get file extension
-	ext := filepath.Ext(imagePath)
-
-	if ext == ".png" {
-		img, err := png.Decode(file)
-		if err != nil {
-			fmt.Println("Error decoding image: ", err)
-			log.Fatal(err)
-		}
-		return img
-
-	} else if ext == ".jpg" || ext == ".jpeg" {
-		img, err := jpeg.Decode(file)
-		if err != nil {
-			fmt.Println("Error decoding image: ", err)
-			log.Fatal(err)
-		}
-		return img
+	var img image.Image
+	switch ext := strings.ToLower(filepath.Ext(imagePath)); ext {
+	case ".png":
+		img, err = png.Decode(file)
+	case ".jpg", ".jpeg":
+		img, err = jpeg.Decode(file)
+	default:
+		return nil, fmt.Errorf("unsupported file format %q", ext)
 	}
-	fmt.Println("Unsupported file format: ", ext)
-	log.Fatal(err)
-	return nil
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	return img, nil
 }
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+func TestResizeImage(t *testing.T) {
+	images := testImages()
+	// 16-bit sources come back from the resize as *image.RGBA64
+	for name, img := range testImages() {
+		wide := image.NewRGBA64(img.Bounds())
+		draw.Draw(wide, wide.Rect, img, img.Bounds().Min, draw.Src)
+		images[name+" 16-bit"] = wide
+	}
+
+	for name, img := range images {
+		t.Run(name, func(t *testing.T) {
+			width, height := img.Bounds().Dx()/3+1, img.Bounds().Dy()/3+1
+			got := ResizeImage(img, width, height)
+
+			// the Lanczos result with every channel clamped to its alpha
+			want := resize.Resize(uint(width), uint(height), img, resize.Lanczos3).(draw.Image)
+			bounds := want.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					r, g, b, a := want.At(x, y).RGBA()
+					want.Set(x, y, color.RGBA64{uint16(min(r, a)), uint16(min(g, a)), uint16(min(b, a)), uint16(a)})
+				}
+			}
+
+			if got.Bounds() != bounds {
+				t.Fatalf("bounds %v, want %v", got.Bounds(), bounds)
+			}
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					if g, w := got.At(x, y), want.At(x, y); g != w {
+						t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBoundImageToScaleMultiple(t *testing.T) {
+	for name, img := range testImages() {
+		t.Run(name, func(t *testing.T) {
+			got := BoundImageToScaleMultiple(img, 7)
+			bounds := img.Bounds()
+			width, height := bounds.Dx()/7*7, bounds.Dy()/7*7
+			if got.Bounds() != image.Rect(0, 0, width, height) {
+				t.Fatalf("bounds %v, want 0,0 to %d,%d", got.Bounds(), width, height)
+			}
+			// the crop is centered, leaving the odd pixel on the right and bottom
+			offset := bounds.Min.Add(image.Pt((bounds.Dx()-width)/2, (bounds.Dy()-height)/2))
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if g, w := got.At(x, y), img.At(offset.X+x, offset.Y+y); color.RGBAModel.Convert(g) != color.RGBAModel.Convert(w) {
+						t.Fatalf("pixel %d,%d is %v, want %v", x, y, g, w)
+					}
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
 	"math"
+	"path/filepath"
 )
 
 func GenerateBrightnessPalette(baseColor color.Color, shades int) []color.Color {
@@ -23,23 +25,53 @@ func GenerateBrightnessPalette(baseColor color.Color, shades int) []color.Color
 	return palette
 }
 
-func GenerateSpicedBrightnessPalette(baseColor color.Color, shades int) []color.Color {
+// Progression spreads the shades of a palette between dark and light.
+type Progression string
+
+const (
+	ProgressionLinear        Progression = "linear"
+	ProgressionLog           Progression = "log"
+	ProgressionInverseSquare Progression = "inverse-square"
+	ProgressionQuadratic     Progression = "quadratic"
+)
+
+func ParseProgression(s string) (Progression, error) {
+	switch p := Progression(s); p {
+	case ProgressionLinear, ProgressionLog, ProgressionInverseSquare, ProgressionQuadratic:
+		return p, nil
+	case "":
+		return ProgressionLinear, nil
+	}
+	return "", fmt.Errorf("unknown progression %q", s)
+}
+
+// Factor returns the position of shade i out of shades, between 0.0 and 1.0.
+func (p Progression) Factor(i, shades int) float64 {
+	if shades < 2 {
+		return 1
+	}
+	switch p {
+	case ProgressionLog:
+		// Logarithmic progression for brightness
+		return math.Log(float64(i+1)) / math.Log(float64(shades))
+	case ProgressionInverseSquare:
+		// Inverse square, normalized so the last shade reaches 1
+		return (1.0 - 1.0/math.Pow(float64(i)/float64(shades-1)+1, 2)) / 0.75
+	case ProgressionQuadratic:
+		return math.Pow(float64(i)/float64(shades-1), 1.4) // Quadratic progression
+	}
+	// Linear progression for brightness
+	return float64(i) / float64(shades-1)
+}
+
+func GenerateSpicedBrightnessPalette(baseColor color.Color, shades int, progression Progression) []color.Color {
 	r, g, b, _ := baseColor.RGBA()
 	baseH, baseS, baseV := RGBToHSV(uint8(r>>8), uint8(g>>8), uint8(b>>8))
 	palette := make([]color.Color, shades)
 
 	// Generate palette with varying saturation or hues for spice
 	for i := 0; i < shades; i++ {
-		// Linear progression for brightness
-		factor := float64(i) / float64(shades-1)
-
-		// Logarithmic progression for brightness
-		// factor := math.Log(float64(i+1)) / math.Log(float64(shades))
-
-		// Inverse square
-		// factor := 1.0 - 1.0/math.Pow(float64(i)/float64(shades-1)+1, 2)
-
-		// factor := math.Pow(float64(i)/float64(shades-1), 1.4) // Quadratic progression
+		factor := progression.Factor(i, shades)
 
 		// Add some hue shift and saturation variation
 		hueShift := math.Sin(factor*math.Pi) * 10 // Oscillates hue for a bit of variety
@@ -56,37 +88,81 @@ func GenerateSpicedBrightnessPalette(baseColor color.Color, shades int) []color.
 	return palette
 }
 
+// GenerateGradientPalette builds a gradient map through evenly spaced color stops, interpolated in OKLab.
+// The first stop maps to the darkest shade and the last to the brightest.
+func GenerateGradientPalette(stops []color.Color, shades int, progression Progression) []color.Color {
+	palette := make([]color.Color, shades)
+	if len(stops) == 1 {
+		for i := range palette {
+			palette[i] = stops[0]
+		}
+		return palette
+	}
+
+	labs := make([][3]float64, len(stops))
+	for i, stop := range stops {
+		labs[i][0], labs[i][1], labs[i][2] = RGBToOKLab(stop)
+	}
+
+	segments := float64(len(stops) - 1)
+	for i := 0; i < shades; i++ {
+		position := Clamp(progression.Factor(i, shades), 0, 1) * segments
+		segment := min(int(position), len(stops)-2)
+		t := position - float64(segment)
+
+		from, to := labs[segment], labs[segment+1]
+		palette[i] = OKLabToRGB(
+			from[0]+(to[0]-from[0])*t,
+			from[1]+(to[1]-from[1])*t,
+			from[2]+(to[2]-from[2])*t,
+		)
+	}
+
+	return palette
+}
+
 // bloom: extract the highlights -> gaussian blur the highlighted image -> combine with original
 
-// create a soft threshold so that the bloom effect fades in instead of being abrupt
-func SoftThreshold(val, thresh float64) float64 {
-	if val < thresh {
+// create a soft threshold so that the bloom effect fades in instead of being abrupt.
+// Returns how much of a pixel with brightness val passes: values more than knee below thresh
+// are cut, values above thresh pass fully, and the knee in between ramps up quadratically.
+func SoftThreshold(val, thresh, knee float64) float64 {
+	if knee <= 0 {
+		if val < thresh {
+			return 0
+		}
+		return 1
+	}
+	if val <= 0 {
 		return 0
 	}
-	return val
+
+	soft := Clamp(val-thresh+knee, 0, 2*knee)
+	soft = soft * soft / (4 * knee)
+	return Clamp(math.Max(soft, val-thresh)/val, 0, 1)
 }
 
 // finds the highlights in the image, notably the bright ones where light will "bleed" into other pixels.
-func ExtractHighlights(img image.Image, thresh float64) image.Image {
-	width := img.Bounds().Dx()
-	height := img.Bounds().Dy()
-	brightnessPass := image.NewRGBA(img.Bounds())
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			brightness := 0.2126*float64(r>>8) + 0.7152*float64(g>>8) + 0.0722*float64(b>>8)
-			if brightness < thresh {
-				continue
+func ExtractHighlights(img image.Image, thresh, knee float64, lum LuminanceModel) *image.RGBA {
+	src := ToRGBA(img)
+	brightnessPass := image.NewRGBA(src.Rect)
+
+	ParallelRows(src.Rect.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			in, out := rowPix(src, y), rowPix(brightnessPass, y)
+			for i := 0; i < len(in); i += 4 {
+				brightness := lum.LuminanceRGBA(in[i], in[i+1], in[i+2], in[i+3]) * 255
+				weight := SoftThreshold(brightness, thresh, knee)
+				if weight == 0 {
+					continue
+				}
+				out[i] = uint8(float64(in[i]) * weight)
+				out[i+1] = uint8(float64(in[i+1]) * weight)
+				out[i+2] = uint8(float64(in[i+2]) * weight)
+				out[i+3] = uint8(float64(in[i+3]) * weight)
 			}
-			brightnessPass.Set(x, y, color.RGBA{
-				uint8(float64(r >> 8)),
-				uint8(float64(g >> 8)),
-				uint8(float64(b >> 8)),
-				uint8(a >> 8),
-			})
 		}
-	}
+	})
 
 	return brightnessPass
 }
@@ -101,68 +177,199 @@ func Clamp(val, min, max float64) float64 {
 	return val
 }
 
-func MergeImages(base, bloom image.Image, intensity float64) image.Image {
-	bounds := base.Bounds()
-	combined := image.NewRGBA(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			br, bg, bb, ba := base.At(x, y).RGBA()
-			bloomR, bloomG, bloomB, _ := bloom.At(x, y).RGBA()
+func MergeImages(base, bloom image.Image, intensity float64) *image.RGBA {
+	baseRGBA, bloomRGBA := ToRGBA(base), ToRGBA(bloom)
+	combined := image.NewRGBA(baseRGBA.Rect)
 
-			r := uint8(Clamp((float64(br>>8)*(1.0-(float64(bloomR>>8)/255.0*intensity)) + float64(bloomR>>8)*intensity), 0, 255))
-			g := uint8(Clamp((float64(bg>>8)*(1.0-(float64(bloomG>>8)/255.0*intensity)) + float64(bloomG>>8)*intensity), 0, 255))
-			b := uint8(Clamp((float64(bb>>8)*(1.0-(float64(bloomB>>8)/255.0*intensity)) + float64(bloomB>>8)*intensity), 0, 255))
+	merge := func(b, glow uint8) uint8 {
+		return uint8(Clamp(float64(b)*(1.0-float64(glow)/255.0*intensity)+float64(glow)*intensity, 0, 255))
+	}
 
-			combined.Set(x, y, color.RGBA{r, g, b, uint8(ba >> 8)})
+	ParallelRows(baseRGBA.Rect.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			b, glow, out := rowPix(baseRGBA, y), rowPix(bloomRGBA, y), rowPix(combined, y)
+			for i := 0; i < len(out); i += 4 {
+				out[i] = merge(b[i], glow[i])
+				out[i+1] = merge(b[i+1], glow[i+1])
+				out[i+2] = merge(b[i+2], glow[i+2])
+				out[i+3] = b[i+3]
+			}
 		}
-	}
+	})
 	return combined
 }
 
-func TintImage(img image.Image, tint color.RGBA) image.Image {
-	width := img.Bounds().Dx()
-	height := img.Bounds().Dy()
-	tinted := image.NewRGBA(img.Bounds())
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			tinted.Set(x, y, color.RGBA{
-				R: uint8(float64(r>>8) * float64(tint.R) / 255),
-				G: uint8(float64(g>>8) * float64(tint.G) / 255),
-				B: uint8(float64(b>>8) * float64(tint.B) / 255),
-				A: uint8(a >> 8),
-			})
+func TintImage(img image.Image, tint color.RGBA) *image.RGBA {
+	src := ToRGBA(img)
+	tinted := image.NewRGBA(src.Rect)
+
+	ParallelRows(src.Rect.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			in, out := rowPix(src, y), rowPix(tinted, y)
+			for i := 0; i < len(in); i += 4 {
+				out[i] = uint8(float64(in[i]) * float64(tint.R) / 255)
+				out[i+1] = uint8(float64(in[i+1]) * float64(tint.G) / 255)
+				out[i+2] = uint8(float64(in[i+2]) * float64(tint.B) / 255)
+				out[i+3] = in[i+3]
+			}
 		}
-	}
+	})
 
 	return tinted
 }
 
-func BloomImage(img image.Image, blurSigma, bloomThreshold, bloomIntensity float64) image.Image {
-	brightnessMap := ExtractHighlights(img, bloomThreshold)
-	SaveImage(brightnessMap, "brightness.png")
-	blurredBrightness, err := StackBlur(brightnessMap, 3*uint32(blurSigma))
+// BloomOptions configures BloomImage.
+type BloomOptions struct {
+	// Radius of the StackBlur applied to the highlights.
+	Radius uint32
+	// Radii are the blur radii of the multi-scale GlowImage. Defaults to Radius, 2*Radius and 4*Radius.
+	Radii []uint32
+	// Intensity scales how strongly the blurred highlights are merged back.
+	Intensity float64
+	// Threshold is the brightness (0-255) above which pixels emit light.
+	Threshold float64
+	// Knee softens the threshold over this many brightness levels below it. 0 is a hard cut.
+	Knee float64
+	// Tint colors the emitted light. The zero value leaves it untinted.
+	Tint      color.RGBA
+	Luminance LuminanceModel
+	// Blend composites the glow onto the image. BloomImage falls back to MergeImages when empty,
+	// GlowImage to an additive blend.
+	Blend BlendMode
+	// DebugDir, if set, receives the intermediate highlight maps.
+	DebugDir string
+}
+
+// BloomImage lights img with its blurred highlights. It stops early with ctx's error once ctx is done.
+func BloomImage(ctx context.Context, img image.Image, opts BloomOptions) (image.Image, error) {
+	brightnessMap := ExtractHighlights(img, opts.Threshold, opts.Knee, opts.Luminance)
+	if opts.Tint.A != 0 {
+		brightnessMap = TintImage(brightnessMap, opts.Tint)
+	}
+	if opts.DebugDir != "" {
+		if err := SaveImageWithText(brightnessMap, filepath.Join(opts.DebugDir, "brightness.png"), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	blurredBrightness, err := StackBlur(ctx, brightnessMap, max(opts.Radius, 1))
 	if err != nil {
-		fmt.Println("error blurring brightness map in BloomImage.")
-		panic(err)
+		return nil, fmt.Errorf("blurring brightness map: %w", err)
+	}
+	if opts.DebugDir != "" {
+		if err := SaveImageWithText(blurredBrightness, filepath.Join(opts.DebugDir, "blurred_brightness.png"), nil); err != nil {
+			return nil, err
+		}
 	}
-	SaveImage(blurredBrightness, "blurred_brightness.png")
 
-	return MergeImages(img, blurredBrightness, bloomIntensity)
+	if opts.Blend == "" {
+		return MergeImages(img, blurredBrightness, opts.Intensity), nil
+	}
+
+	// scale the glow by the intensity, then let the blend mode decide how it lights the image
+	scaled := image.NewRGBA(blurredBrightness.Bounds())
+	for i := 0; i < len(scaled.Pix); i += 4 {
+		scaled.Pix[i] = uint8(Clamp(float64(blurredBrightness.Pix[i])*opts.Intensity, 0, 255))
+		scaled.Pix[i+1] = uint8(Clamp(float64(blurredBrightness.Pix[i+1])*opts.Intensity, 0, 255))
+		scaled.Pix[i+2] = uint8(Clamp(float64(blurredBrightness.Pix[i+2])*opts.Intensity, 0, 255))
+		scaled.Pix[i+3] = 255
+	}
+	return BlendImagesContext(ctx, img, scaled, opts.Blend, 1)
 }
 
-func ApplyColorBurn(img image.Image, burnFactor float64) image.Image {
+// GlowImage is a multi-scale bloom for the final rendered image: the highlights are blurred at every
+// radius and added on top of the image, so small radii give glyphs a tight halo and large radii a soft haze.
+// Where img is transparent the glow is kept as translucent light. It stops early with ctx's error once ctx is done.
+func GlowImage(ctx context.Context, img *image.RGBA, opts BloomOptions) (*image.RGBA, error) {
+	radii := opts.Radii
+	if len(radii) == 0 {
+		radius := max(opts.Radius, 1)
+		radii = []uint32{radius, radius * 2, radius * 4}
+	}
+
+	highlights := ExtractHighlights(img, opts.Threshold, opts.Knee, opts.Luminance)
+	if opts.Tint.A != 0 {
+		highlights = TintImage(highlights, opts.Tint)
+	}
+	if opts.DebugDir != "" {
+		if err := SaveImageWithText(highlights, filepath.Join(opts.DebugDir, "glyph_highlights.png"), nil); err != nil {
+			return nil, err
+		}
+	}
+
 	bounds := img.Bounds()
-	burnedImg := image.NewRGBA(bounds)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			burned_r, burned_g, burned_b := ColorBurn(uint8(r>>8), burnFactor), ColorBurn(uint8(g>>8), burnFactor), ColorBurn(uint8(b>>8), burnFactor)
-			burnedImg.Set(x, y, color.RGBA{burned_r, burned_g, burned_b, uint8(a >> 8)})
+	glow := make([]float64, bounds.Dx()*bounds.Dy()*3)
+	weight := opts.Intensity / float64(len(radii))
+
+	for _, radius := range radii {
+		blurred, err := StackBlur(ctx, highlights, max(radius, 1))
+		if err != nil {
+			return nil, fmt.Errorf("blurring highlights: %w", err)
 		}
+		for i, j := 0, 0; i < len(blurred.Pix); i, j = i+4, j+3 {
+			glow[j] += float64(blurred.Pix[i]) * weight
+			glow[j+1] += float64(blurred.Pix[i+1]) * weight
+			glow[j+2] += float64(blurred.Pix[i+2]) * weight
+		}
+	}
+
+	glowLayer := image.NewRGBA(bounds)
+	for i, j := 0, 0; i < len(glowLayer.Pix); i, j = i+4, j+3 {
+		glowLayer.Pix[i] = uint8(Clamp(glow[j], 0, 255))
+		glowLayer.Pix[i+1] = uint8(Clamp(glow[j+1], 0, 255))
+		glowLayer.Pix[i+2] = uint8(Clamp(glow[j+2], 0, 255))
+		glowLayer.Pix[i+3] = 255
+	}
+
+	mode := opts.Blend
+	if mode == "" {
+		mode = BlendAdditive
+	}
+	glowed, err := BlendImagesContext(ctx, img, glowLayer, mode, 1)
+	if err != nil {
+		return nil, err
 	}
+
+	// the blend keeps img's alpha, so where img is (partly) transparent the glow is laid
+	// underneath as light of its own, covering as much as its brightest channel
+	err = ParallelRowsContext(ctx, bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			out, g := rowPix(glowed, y), rowPix(glowLayer, y)
+			for i := 0; i < len(out); i += 4 {
+				uncovered := 255 - uint32(out[i+3])
+				if uncovered == 0 {
+					continue
+				}
+				glowAlpha := max(g[i], g[i+1], g[i+2])
+				out[i] += uint8((uint32(g[i])*uncovered + 127) / 255)
+				out[i+1] += uint8((uint32(g[i+1])*uncovered + 127) / 255)
+				out[i+2] += uint8((uint32(g[i+2])*uncovered + 127) / 255)
+				out[i+3] += uint8((uint32(glowAlpha)*uncovered + 127) / 255)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return glowed, nil
+}
+
+// ApplyColorBurn multiplies every channel by burnFactor and clamps it to the pixel's alpha. Despite
+// the name it is a brightness boost rather than a color burn; see BlendImages with BlendColorBurn
+// for the real thing.
+func ApplyColorBurn(img image.Image, burnFactor float64) *image.RGBA {
+	src := ToRGBA(img)
+	burnedImg := image.NewRGBA(src.Rect)
+	ParallelRows(src.Rect.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			in, out := rowPix(src, y), rowPix(burnedImg, y)
+			for i := 0; i < len(in); i += 4 {
+				a := in[i+3]
+				out[i], out[i+1], out[i+2] = min(ColorBurn(in[i], burnFactor), a), min(ColorBurn(in[i+1], burnFactor), a), min(ColorBurn(in[i+2], burnFactor), a)
+				out[i+3] = in[i+3]
+			}
+		}
+	})
 	return burnedImg
 }
 
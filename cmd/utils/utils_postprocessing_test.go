@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestGlowImageOnTransparentCanvas(t *testing.T) {
+	for _, canvas := range []color.RGBA{{}, {A: 255}} {
+		img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+		for i := 0; i < len(img.Pix); i += 4 {
+			copy(img.Pix[i:], []uint8{canvas.R, canvas.G, canvas.B, canvas.A})
+		}
+		// a white glyph in the middle
+		for y := 14; y < 18; y++ {
+			for x := 14; x < 18; x++ {
+				img.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+			}
+		}
+
+		glowed, err := GlowImage(context.Background(), img, BloomOptions{Radius: 2, Intensity: 1, Threshold: 128})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := glowed.RGBAAt(12, 16)
+		if got.A == 0 || got.R == 0 || got.R > got.A {
+			t.Errorf("canvas %v: pixel next to the glyph is %v, want a visible glow", canvas, got)
+		}
+		if got := glowed.RGBAAt(16, 16); got != (color.RGBA{255, 255, 255, 255}) {
+			t.Errorf("canvas %v: glyph pixel is %v, want white", canvas, got)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// PreprocessOptions configures the tone mapping applied to the source image before it is downscaled.
+// The zero value leaves the image untouched.
+type PreprocessOptions struct {
+	// AutoLevels stretches the tonal range so the darkest and brightest pixels reach black and white.
+	AutoLevels bool
+	// LevelsClip is the percentage of pixels allowed to clip at each end when auto-leveling.
+	LevelsClip float64
+	// Equalize flattens the luminance histogram of the whole image.
+	Equalize bool
+	// CLAHE equalizes the histogram per tile with a clip limit, boosting local contrast without blowing out noise.
+	CLAHE          bool
+	CLAHETiles     int
+	CLAHEClipLimit float64
+	// Brightness is added to every channel, between -1 and 1.
+	Brightness float64
+	// Contrast scales channels around mid-gray by 1 + Contrast, so 0 leaves the image unchanged.
+	Contrast float64
+	// Gamma brightens midtones above 1 and darkens them below 1. 0 is treated as 1.
+	Gamma float64
+}
+
+func (o PreprocessOptions) enabled() bool {
+	return o.AutoLevels || o.Equalize || o.CLAHE || o.Brightness != 0 || o.Contrast != 0 || (o.Gamma != 0 && o.Gamma != 1)
+}
+
+// NeedsWholeImage reports whether any enabled step derives its mapping from statistics of the whole
+// image, so it can't be applied to parts of the image independently.
+func (o PreprocessOptions) NeedsWholeImage() bool {
+	return o.AutoLevels || o.Equalize || o.CLAHE
+}
+
+// Preprocess applies auto-levels, histogram equalization or CLAHE, brightness/contrast and gamma, in that order.
+// The steps work on un-premultiplied colors and leave alpha alone; fully transparent pixels are
+// neither counted in the histograms nor changed. It stops early with ctx's error once ctx is done.
+func Preprocess(ctx context.Context, img image.Image, opts PreprocessOptions) (image.Image, error) {
+	if !opts.enabled() {
+		return img, nil
+	}
+
+	processed := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(processed, processed.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	if opts.AutoLevels {
+		autoLevels(processed, opts.LevelsClip)
+	}
+	if opts.Equalize {
+		equalizeHistogram(processed)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if opts.CLAHE {
+		tiles := opts.CLAHETiles
+		if tiles <= 0 {
+			tiles = 8
+		}
+		clipLimit := opts.CLAHEClipLimit
+		if clipLimit <= 0 {
+			clipLimit = 2
+		}
+		if err := applyCLAHE(ctx, processed, tiles, clipLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	gamma := opts.Gamma
+	if gamma == 0 {
+		gamma = 1
+	}
+	if opts.Brightness != 0 || opts.Contrast != 0 || gamma != 1 {
+		var lut [256]uint8
+		for i := range lut {
+			v := float64(i) / 255.0
+			v = (v-0.5)*(1+opts.Contrast) + 0.5 + opts.Brightness
+			v = math.Pow(Clamp(v, 0, 1), 1/gamma)
+			lut[i] = uint8(math.Round(v * 255))
+		}
+		applyChannelLUT(processed, &lut)
+	}
+
+	// premultiply again for the rest of the pipeline
+	result := image.NewRGBA(processed.Bounds())
+	draw.Draw(result, result.Bounds(), processed, image.Point{}, draw.Src)
+	return result, nil
+}
+
+func applyChannelLUT(img *image.NRGBA, lut *[256]uint8) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		img.Pix[i] = lut[img.Pix[i]]
+		img.Pix[i+1] = lut[img.Pix[i+1]]
+		img.Pix[i+2] = lut[img.Pix[i+2]]
+	}
+}
+
+// autoLevels maps the clipPercent-th and (100 - clipPercent)-th percentile of all channels to 0 and 255.
+// The same mapping is used for all channels so colors don't shift.
+func autoLevels(img *image.NRGBA, clipPercent float64) {
+	var histogram [256]int
+	total := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		histogram[img.Pix[i]]++
+		histogram[img.Pix[i+1]]++
+		histogram[img.Pix[i+2]]++
+		total += 3
+	}
+	clip := int(float64(total) * clipPercent / 100)
+
+	low, count := 0, 0
+	for ; low < 255; low++ {
+		count += histogram[low]
+		if count > clip {
+			break
+		}
+	}
+	high := 255
+	count = 0
+	for ; high > 0; high-- {
+		count += histogram[high]
+		if count > clip {
+			break
+		}
+	}
+	if high <= low {
+		return
+	}
+
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = uint8(Clamp(math.Round(float64(i-low)*255/float64(high-low)), 0, 255))
+	}
+	applyChannelLUT(img, &lut)
+}
+
+func pixelLuminance(pix []uint8) uint8 {
+	return uint8(0.2126*float64(pix[0]) + 0.7152*float64(pix[1]) + 0.0722*float64(pix[2]) + 0.5)
+}
+
+// remapLuminance moves a pixel to a new luminance while keeping its hue and saturation,
+// by scaling all channels by the same ratio.
+func remapLuminance(pix []uint8, from, to uint8) {
+	if from == to {
+		return
+	}
+	if from == 0 {
+		pix[0], pix[1], pix[2] = to, to, to
+		return
+	}
+	ratio := float64(to) / float64(from)
+	pix[0] = uint8(Clamp(float64(pix[0])*ratio, 0, 255))
+	pix[1] = uint8(Clamp(float64(pix[1])*ratio, 0, 255))
+	pix[2] = uint8(Clamp(float64(pix[2])*ratio, 0, 255))
+}
+
+// cumulativeLUT turns a histogram into an equalization lookup table. An empty histogram gives
+// the identity.
+func cumulativeLUT(histogram *[256]float64) [256]uint8 {
+	var total float64
+	for _, count := range histogram {
+		total += count
+	}
+
+	var lut [256]uint8
+	if total == 0 {
+		for i := range lut {
+			lut[i] = uint8(i)
+		}
+		return lut
+	}
+	var cdf float64
+	for i, count := range histogram {
+		cdf += count
+		lut[i] = uint8(math.Round(cdf / total * 255))
+	}
+	return lut
+}
+
+func equalizeHistogram(img *image.NRGBA) {
+	var histogram [256]float64
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] != 0 {
+			histogram[pixelLuminance(img.Pix[i:i+3])]++
+		}
+	}
+
+	lut := cumulativeLUT(&histogram)
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			continue
+		}
+		lum := pixelLuminance(img.Pix[i : i+3])
+		remapLuminance(img.Pix[i:i+3], lum, lut[lum])
+	}
+}
+
+// applyCLAHE runs contrast limited adaptive histogram equalization on a tiles x tiles grid.
+// Each tile's histogram is clipped at clipLimit times the average bin height and the excess is
+// spread over all bins; pixels then blend the lookup tables of the four nearest tile centers.
+func applyCLAHE(ctx context.Context, img *image.NRGBA, tiles int, clipLimit float64) error {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	tilesX, tilesY := min(tiles, width), min(tiles, height)
+	if tilesX < 1 || tilesY < 1 {
+		return nil
+	}
+	tileW := float64(width) / float64(tilesX)
+	tileH := float64(height) / float64(tilesY)
+
+	lums := make([]uint8, width*height)
+	err := ParallelRowsContext(ctx, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				i := img.PixOffset(x, y)
+				lums[y*width+x] = pixelLuminance(img.Pix[i : i+3])
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	luts := make([][256]uint8, tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for tx := 0; tx < tilesX; tx++ {
+			var histogram [256]float64
+			y0, y1 := int(float64(ty)*tileH), int(float64(ty+1)*tileH)
+			x0, x1 := int(float64(tx)*tileW), int(float64(tx+1)*tileW)
+			counted := 0
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					if img.Pix[img.PixOffset(x, y)+3] != 0 {
+						histogram[lums[y*width+x]]++
+						counted++
+					}
+				}
+			}
+
+			limit := clipLimit * float64(counted) / 256
+			var excess float64
+			for i := range histogram {
+				if histogram[i] > limit {
+					excess += histogram[i] - limit
+					histogram[i] = limit
+				}
+			}
+			for i := range histogram {
+				histogram[i] += excess / 256
+			}
+
+			luts[ty*tilesX+tx] = cumulativeLUT(&histogram)
+		}
+	}
+
+	return ParallelRowsContext(ctx, height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			// position relative to the tile centers
+			fy := Clamp((float64(y)+0.5)/tileH-0.5, 0, float64(tilesY-1))
+			ty0 := int(fy)
+			ty1 := min(ty0+1, tilesY-1)
+			wy := fy - float64(ty0)
+
+			for x := 0; x < width; x++ {
+				fx := Clamp((float64(x)+0.5)/tileW-0.5, 0, float64(tilesX-1))
+				tx0 := int(fx)
+				tx1 := min(tx0+1, tilesX-1)
+				wx := fx - float64(tx0)
+
+				i := img.PixOffset(x, y)
+				if img.Pix[i+3] == 0 {
+					continue
+				}
+				lum := lums[y*width+x]
+				top := (1-wx)*float64(luts[ty0*tilesX+tx0][lum]) + wx*float64(luts[ty0*tilesX+tx1][lum])
+				bottom := (1-wx)*float64(luts[ty1*tilesX+tx0][lum]) + wx*float64(luts[ty1*tilesX+tx1][lum])
+				mapped := uint8(math.Round((1-wy)*top + wy*bottom))
+				remapLuminance(img.Pix[i:i+3], lum, mapped)
+			}
+		}
+	})
+}
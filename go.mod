@@ -6,10 +6,10 @@ require (
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // direct
 	golang.org/x/image v0.22.0 // direct
 	github.com/spf13/cobra v1.8.1 // direct
+	github.com/spf13/pflag v1.0.5 // direct
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/text v0.20.0 // indirect
 )
@@ -3,14 +3,20 @@ package main
 import (
 	asciify "asciify/cmd"
 	"asciify/cmd/utils"
+	"context"
 	"embed"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -24,6 +30,46 @@ var (
 	outputFile         string
 	scaleFactor        int
 	bloomThreshold     = 235
+	renderMode         = "ascii"
+	terminal           = false
+	brailleSource      = "luminance"
+	brailleThreshold   = 0.5
+	ditherMethod       = "none"
+	luminanceModel     = "rec709"
+	gradientStops      string
+	shades             = 8
+	progression        = "linear"
+	preprocess         utils.PreprocessOptions
+	bloomOptions       utils.BloomOptions
+	bloomTintHex       string
+	bloomRadii         []uint
+	bloomTarget        = "source"
+	debugDir           string
+	burnMode           string
+	burnStrength       = 0.5
+	bloomBlend         string
+	composite          = false
+	compositeOpacity   = 1.0
+	compositeBlend     = "screen"
+	compositeBlur      uint32
+	compositeDarken    = 0.5
+	transparent        = false
+	alphaMode          = "empty"
+	alphaThreshold     = 0.1
+	cellBackground     = "none"
+	cellBgDarken       = 0.3
+	cellBgDesaturate   = 0.3
+	paletteName        string
+	paletteDither      = "none"
+	paletteMethod      = "kmeans"
+	exportPalette      string
+	tiled              = false
+	tileRows           = 64
+	timeout            time.Duration
+	stageNames         []string
+	presetName         string
+	recursive          = false
+	jobs               = 2
 )
 
 func getDefaultSaveDir() (string, error) {
@@ -78,54 +124,402 @@ var rootCmd = &cobra.Command{
 	Short:   "a CLI tool for converting an image to ASCII art",
 	Version: "v1.0.0",
 	Long:    "asciify converts whichever image you choose to an ASCII art representation, complete with different processing effects and extended color options.",
+	// the image path is a positional argument next to the subcommands
+	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) < 1 {
 			fmt.Println("Please provide a path to an image file. Run 'asciify --help' for more information.")
 			os.Exit(1)
 		}
-		inputPath := args[0]
+		inputs, err := expandInputs(args, recursive)
+		if err != nil {
+			fmt.Println("Error finding images:", err)
+			os.Exit(1)
+		}
+		if len(inputs) == 0 {
+			fmt.Println("No images found.")
+			os.Exit(1)
+		}
+		if err := checkOutputFlags(inputs); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		job, err := newRenderJob(cmd)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Using embedded font at", job.opts.FontPath)
+		fmt.Println("monochrome: ", job.opts.Monochrome)
 
-		fontPath, err := setupFontPath()
-		fmt.Println("Using embedded font at", fontPath)
+		// every image shares the loaded font and its glyph cache
+		pipeline, err := asciify.NewPipeline(job.opts)
 		if err != nil {
-			fmt.Println("Error setting up font path:", err)
+			fmt.Println("Error building pipeline:", err)
 			os.Exit(1)
 		}
 
-		if backgroundColorHex[0] != '#' {
-			backgroundColorHex = "#" + backgroundColorHex
+		// Ctrl+C stops the render between rows instead of killing it mid-write
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := job.renderInputs(ctx, pipeline, inputs); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
 		}
+		// defer os.Remove(temporaryFontPath)
+	},
+}
+
+// checkOutputFlags rejects the flags that name a single output when there are several inputs.
+// --file renames the only output.
+func checkOutputFlags(inputs []imageInput) error {
+	batch := len(inputs) > 1
+	if outputFile != "output.png" {
+		if batch {
+			return errors.New("--file only works with a single image; outputs are named after their inputs.")
+		}
+		inputs[0].output = outputFile
+	}
+	if exportPalette != "" && batch {
+		return errors.New("--export-palette only works with a single image.")
+	}
+	return nil
+}
 
-		if baseColorHex[0] != '#' {
-			baseColorHex = "#" + baseColorHex
+// renderJob is a render configured by the flags, ready to be run on any number of images.
+type renderJob struct {
+	opts             asciify.Options
+	extractionMethod utils.PaletteExtraction
+	// auto:N gradients and palettes are extracted from every image separately
+	autoGradient, autoPalette int
+	// exportPalette is where the extracted palette is written, if anywhere
+	exportPalette string
+}
+
+// newRenderJob applies the preset and parses the flags of cmd into render options.
+func newRenderJob(cmd *cobra.Command) (*renderJob, error) {
+	if presetName != "" {
+		if err := applyPreset(cmd, presetName); err != nil {
+			return nil, fmt.Errorf("applying preset: %w", err)
 		}
+	}
+
+	fontPath, err := setupFontPath()
+	if err != nil {
+		return nil, fmt.Errorf("setting up font path: %w", err)
+	}
+
+	if backgroundColorHex == "" || baseColorHex == "" {
+		return nil, errors.New("base and background colors can't be empty")
+	}
+	if backgroundColorHex[0] != '#' {
+		backgroundColorHex = "#" + backgroundColorHex
+	}
+
+	if baseColorHex[0] != '#' {
+		baseColorHex = "#" + baseColorHex
+	}
+
+	backgroundColor, err := utils.ParseHexColorFast(backgroundColorHex)
+	if err != nil {
+		return nil, fmt.Errorf("parsing background color: %w", err)
+	}
+	baseColor, err := utils.ParseHexColorFast(baseColorHex)
+	if err != nil {
+		return nil, fmt.Errorf("parsing base color: %w", err)
+	}
+	if scaleFactor < 1 {
+		return nil, fmt.Errorf("scale must be at least 1, not %d", scaleFactor)
+	}
+	if cellBgDarken < 0 || cellBgDarken > 1 || cellBgDesaturate < 0 || cellBgDesaturate > 1 {
+		return nil, errors.New("cell-bg-darken and cell-bg-desaturate must be between 0 and 1")
+	}
+
+	mode, err := asciify.ParseRenderMode(renderMode)
+	if err != nil {
+		return nil, fmt.Errorf("parsing render mode: %w", err)
+	}
 
-		inputImage := utils.LoadImage(inputPath)
-		fmt.Println("Image loaded successfully.")
-		reboundedImage := utils.BoundImageToScaleMultiple(inputImage, 8)
+	dither, err := utils.ParseDitherMethod(ditherMethod)
+	if err != nil {
+		return nil, fmt.Errorf("parsing dither method: %w", err)
+	}
+
+	job := &renderJob{exportPalette: exportPalette}
+	job.extractionMethod, err = utils.ParsePaletteExtraction(paletteMethod)
+	if err != nil {
+		return nil, fmt.Errorf("parsing palette extraction method: %w", err)
+	}
 
-		backgroundColor, errBg := utils.ParseHexColorFast(backgroundColorHex)
-		if errBg != nil {
-			panic("Error parsing background color.")
+	var gradient []color.Color
+	mono := monochrome
+	if n, auto, err := utils.ParseAutoPalette(gradientStops); auto {
+		if err != nil {
+			return nil, fmt.Errorf("parsing gradient: %w", err)
 		}
-		baseColor, errBase := utils.ParseHexColorFast(baseColorHex)
-		if errBase != nil {
-			panic("Error parsing base color.")
+		job.autoGradient = n
+		mono = true
+	} else if gradientStops != "" {
+		gradient, err = utils.ParseHexColorList(gradientStops)
+		if err != nil {
+			return nil, fmt.Errorf("parsing gradient: %w", err)
+		}
+		// a gradient map only applies to monochrome rendering
+		mono = true
+	}
+
+	shadeProgression, err := utils.ParseProgression(progression)
+	if err != nil {
+		return nil, fmt.Errorf("parsing progression: %w", err)
+	}
+
+	lumModel, err := utils.ParseLuminanceModel(luminanceModel)
+	if err != nil {
+		return nil, fmt.Errorf("parsing luminance model: %w", err)
+	}
+
+	source, err := asciify.ParseBrailleSource(brailleSource)
+	if err != nil {
+		return nil, fmt.Errorf("parsing braille source: %w", err)
+	}
+
+	target, err := asciify.ParseBloomTarget(bloomTarget)
+	if err != nil {
+		return nil, fmt.Errorf("parsing bloom target: %w", err)
+	}
+
+	var burnBlend utils.BlendMode
+	if burnMode != "" {
+		burnBlend, err = utils.ParseBlendMode(burnMode)
+		if err != nil {
+			return nil, fmt.Errorf("parsing burn mode: %w", err)
 		}
-		startTime := time.Now()
-		outputFileName := outputFile
-		if outputFile == "output.png" {
-			inputFile := filepath.Base(inputPath)
-			outputFileName = strings.Split(inputFile, ".")[0] + ".png"
+	}
+	// the flags only fill in part of the bloom options, the rest is derived here
+	bloomOpts := bloomOptions
+	if bloomBlend != "" {
+		bloomOpts.Blend, err = utils.ParseBlendMode(bloomBlend)
+		if err != nil {
+			return nil, fmt.Errorf("parsing bloom blend mode: %w", err)
 		}
-		outputPath := filepath.Join(outputDir, outputFileName)
-		fmt.Println("monochrome: ", monochrome)
+	}
 
-		asciify.AsciifyImage(reboundedImage, outputPath, fontPath, 8, bloomThreshold, backgroundColor, baseColor, bloom, crt, monochrome, burn)
-		fmt.Println("Image saved to", outputPath)
+	compositeMode, err := utils.ParseBlendMode(compositeBlend)
+	if err != nil {
+		return nil, fmt.Errorf("parsing composite blend mode: %w", err)
+	}
+
+	alpha, err := asciify.ParseAlphaMode(alphaMode)
+	if err != nil {
+		return nil, fmt.Errorf("parsing alpha mode: %w", err)
+	}
+
+	cellBgMode, err := asciify.ParseCellBackgroundMode(cellBackground)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cell background mode: %w", err)
+	}
+
+	var colorPalette []color.Color
+	if n, auto, err := utils.ParseAutoPalette(paletteName); auto {
+		if err != nil {
+			return nil, fmt.Errorf("parsing palette: %w", err)
+		}
+		job.autoPalette = n
+	} else if paletteName != "" {
+		colorPalette, err = utils.LoadPalette(paletteName)
+		if err != nil {
+			return nil, fmt.Errorf("loading palette: %w", err)
+		}
+	}
+	colorPaletteDither, err := utils.ParseDitherMethod(paletteDither)
+	if err != nil {
+		return nil, fmt.Errorf("parsing palette dither method: %w", err)
+	}
+
+	bloomOpts.Threshold = float64(bloomThreshold)
+	for _, radius := range bloomRadii {
+		bloomOpts.Radii = append(bloomOpts.Radii, uint32(radius))
+	}
+	if target == asciify.BloomGlyphs && !cmd.Flags().Changed("bloom-intensity") {
+		// glyph glow is added on top of the image, so it needs far less strength than the source bloom
+		bloomOpts.Intensity = 1
+	}
+	if bloomTintHex != "" {
+		if bloomTintHex[0] != '#' {
+			bloomTintHex = "#" + bloomTintHex
+		}
+		bloomOpts.Tint, err = utils.ParseHexColorFast(bloomTintHex)
+		if err != nil {
+			return nil, fmt.Errorf("parsing bloom tint: %w", err)
+		}
+	}
+
+	if debugDir != "" {
+		if err := os.MkdirAll(debugDir, 0755); err != nil {
+			return nil, fmt.Errorf("creating debug directory: %w", err)
+		}
+	}
+
+	job.opts = asciify.Options{
+		FontPath:        fontPath,
+		ScaleFactor:     scaleFactor,
+		BackgroundColor: backgroundColor,
+		BaseColor:       baseColor,
+		Bloom:           bloom,
+		CRT:             crt,
+		Monochrome:      mono,
+		Gradient:        gradient,
+		Shades:          shades,
+		Progression:     shadeProgression,
+		Burn:            burn,
+		Mode:            mode,
+
+		BrailleSource:            source,
+		BrailleThreshold:         brailleThreshold,
+		Dither:                   dither,
+		Luminance:                lumModel,
+		Preprocess:               preprocess,
+		BloomOptions:             bloomOpts,
+		BloomTarget:              target,
+		AlphaMode:                alpha,
+		AlphaThreshold:           alphaThreshold,
+		Transparent:              transparent,
+		CellBackground:           cellBgMode,
+		CellBackgroundDarken:     cellBgDarken,
+		CellBackgroundDesaturate: cellBgDesaturate,
+		Palette:                  colorPalette,
+		PaletteDither:            colorPaletteDither,
+
+		Composite:        composite,
+		CompositeOpacity: compositeOpacity,
+		CompositeBlend:   compositeMode,
+		CompositeBlur:    compositeBlur,
+		CompositeDarken:  compositeDarken,
+		BurnMode:         burnBlend,
+		BurnStrength:     burnStrength,
+		DebugDir:         debugDir,
+		TileRows:         tileRows,
+		Stages:           stageNames,
+	}
+	if terminal {
+		job.opts.Terminal = os.Stdout
+	}
+	job.opts.Metadata, err = renderMetadata(cmd, fontPath)
+	if err != nil {
+		return nil, fmt.Errorf("recording settings: %w", err)
+	}
+	return job, nil
+}
+
+// renderInputs renders the inputs with pipeline, which must have been built for the job's options.
+// A single image gets a progress bar, several are rendered on the worker pool. --timeout applies
+// to the whole call.
+func (j *renderJob) renderInputs(ctx context.Context, pipeline *asciify.Pipeline, inputs []imageInput) error {
+	startTime := time.Now()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if len(inputs) > 1 {
+		render := func(ctx context.Context, input imageInput) error {
+			return j.renderFile(ctx, pipeline, input)
+		}
+		if failed := runBatch(ctx, inputs, jobs, render); failed > 0 {
+			return fmt.Errorf("%d of %d images failed", failed, len(inputs))
+		}
 		fmt.Println("Time taken:", time.Since(startTime))
-		// defer os.Remove(temporaryFontPath)
-	},
+		return nil
+	}
+
+	bar := newProgressBar()
+	if bar != nil {
+		opts := pipeline.Options()
+		opts.Progress = bar
+		var err error
+		if pipeline, err = pipeline.WithOptions(opts); err != nil {
+			return err
+		}
+	}
+	err := j.renderFile(ctx, pipeline, inputs[0])
+	if bar != nil {
+		bar.Done()
+	}
+	if err != nil {
+		return fmt.Errorf("rendering %s: %w", inputs[0].path, err)
+	}
+	fmt.Println("Image saved to", filepath.Join(outputDir, inputs[0].output))
+	fmt.Println("Time taken:", time.Since(startTime))
+	return nil
+}
+
+// imagePipeline returns pipeline with the auto:N palettes extracted from img, and writes
+// --export-palette.
+func (j *renderJob) imagePipeline(pipeline *asciify.Pipeline, img image.Image) (*asciify.Pipeline, error) {
+	if j.autoGradient == 0 && j.autoPalette == 0 && j.exportPalette == "" {
+		return pipeline, nil
+	}
+	var extracted []color.Color
+	extractPalette := func(n int) []color.Color {
+		_, _, downscaled := utils.DownscaleImage(img, j.opts.ScaleFactor)
+		extracted = utils.ExtractPalette(downscaled, n, j.extractionMethod)
+		return extracted
+	}
+	imageOpts := pipeline.Options()
+	if j.autoGradient > 0 {
+		imageOpts.Gradient = extractPalette(j.autoGradient)
+	}
+	if j.autoPalette > 0 {
+		imageOpts.Palette = extractPalette(j.autoPalette)
+	}
+	if j.exportPalette != "" {
+		if extracted == nil {
+			extractPalette(8)
+		}
+		if err := writePalette(j.exportPalette, extracted); err != nil {
+			return nil, err
+		}
+	}
+	return pipeline.WithOptions(imageOpts)
+}
+
+// renderFile loads one input and renders it under --directory.
+func (j *renderJob) renderFile(ctx context.Context, pipeline *asciify.Pipeline, input imageInput) error {
+	inputImage, err := utils.LoadImage(input.path)
+	if err != nil {
+		return err
+	}
+	// tiled rendering crops to whole cells band by band instead of copying the whole image
+	reboundedImage := inputImage
+	if !tiled {
+		reboundedImage = utils.BoundImageToScaleMultiple(inputImage, j.opts.ScaleFactor)
+	}
+
+	if pipeline, err = j.imagePipeline(pipeline, reboundedImage); err != nil {
+		return err
+	}
+
+	outputPath := filepath.Join(outputDir, input.output)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+	if tiled {
+		return pipeline.RenderTiled(ctx, reboundedImage, outputPath)
+	}
+	return pipeline.Render(ctx, reboundedImage, outputPath)
+}
+
+// writePalette prints the extracted palette and saves it as <path>.hex and a <path>.png swatch.
+func writePalette(path string, palette []color.Color) error {
+	hexList := utils.FormatHexPalette(palette)
+	fmt.Print("Extracted palette:\n", hexList)
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	if err := os.WriteFile(base+".hex", []byte(hexList), 0644); err != nil {
+		return fmt.Errorf("error writing palette: %w", err)
+	}
+	return utils.SaveImageWithText(utils.PaletteSwatch(palette, 64), base+".png", nil)
 }
 
 // Execute runs the CLI
@@ -140,17 +534,86 @@ func init() {
 		fmt.Println("Error getting default save directory:", err)
 		os.Exit(1)
 	}
+	addRenderFlags(renderFlags, defaultSaveDir)
+	for _, cmd := range []*cobra.Command{rootCmd, watchCmd, serveCmd} {
+		addRenderFlags(cmd.Flags(), defaultSaveDir)
+	}
+	// serve answers over HTTP, so flags about files and the terminal mean nothing to it
+	for _, name := range serveIgnored {
+		serveCmd.Flags().MarkHidden(name)
+	}
+}
+
+// renderFlags holds the flags addRenderFlags defines, apart from those a command adds itself.
+var renderFlags = pflag.NewFlagSet("render", pflag.ContinueOnError)
+
+// addRenderFlags defines the flags that configure a render. The render commands share them.
+func addRenderFlags(flags *pflag.FlagSet, defaultSaveDir string) {
+	flags.StringVarP(&outputDir, "directory", "d", defaultSaveDir, "Path to save the output image. Default: ~/asciify")
+	flags.BoolVar(&recursive, "recursive", false, "Also render images in subdirectories of directory arguments; outputs mirror the input tree under --directory")
+	flags.IntVarP(&jobs, "jobs", "j", 2, "Number of images rendered at the same time when several are given")
+	flags.StringVarP(&outputFile, "file", "f", "output.png", "Name of the .png output file")
+	flags.IntVarP(&scaleFactor, "scale", "s", 8, "Scale factor for resizing")
+	flags.StringVar(&presetName, "preset", "", "Start from a named set of flags: retro-amber, matrix-green, newspaper, neon or one defined in ~/.asciify/config.json. Flags given explicitly win over the preset")
+	flags.StringVar(&baseColorHex, "base-color", "f5bea3", "Hex color the monochrome palette is built from")
+	flags.StringVar(&backgroundColorHex, "background-color", "110301", "Hex background color of monochrome renders")
+	flags.IntVarP(&bloomThreshold, "thresh", "t", 235, "Threshold for which pixel values are considered bright enough to bloom (emit light)")
+	flags.StringVar(&renderMode, "mode", "ascii", "Render mode: ascii, halfblock, quadrant, sextant or braille. Block modes pack 2, 4 or 6 colored pixels into each cell, braille packs 8 dots.")
+	flags.StringVar(&brailleSource, "braille-source", "luminance", "What raises braille dots: luminance or edges (Sobel edge map)")
+	flags.Float64Var(&brailleThreshold, "braille-thresh", 0.5, "Intensity between 0 and 1 above which a braille dot is raised")
+	flags.StringVar(&ditherMethod, "dither", "none", "Dithering used when quantizing luminance to glyphs, palette shades or braille dots: none, ordered, floyd-steinberg, atkinson or jarvis")
+	flags.StringVar(&luminanceModel, "luminance", "rec709", "How brightness is computed: perceptual (L*), linear, rec601 or rec709")
+
+	// Flags for tone mapping
+	flags.BoolVar(&preprocess.AutoLevels, "auto-levels", false, "Stretch the tonal range of the source to full black and white")
+	flags.Float64Var(&preprocess.LevelsClip, "levels-clip", 0.5, "Percentage of pixels allowed to clip at each end when using --auto-levels")
+	flags.BoolVar(&preprocess.Equalize, "equalize", false, "Equalize the luminance histogram of the source")
+	flags.BoolVar(&preprocess.CLAHE, "clahe", false, "Apply contrast limited adaptive histogram equalization to the source")
+	flags.IntVar(&preprocess.CLAHETiles, "clahe-tiles", 8, "Number of CLAHE tiles along each axis")
+	flags.Float64Var(&preprocess.CLAHEClipLimit, "clahe-clip", 2.0, "CLAHE clip limit, as a multiple of the average histogram bin")
+	flags.Float64Var(&preprocess.Brightness, "brightness", 0, "Brightness offset between -1 and 1")
+	flags.Float64Var(&preprocess.Contrast, "contrast", 0, "Contrast adjustment; 0 keeps the source, 0.5 is 50% more contrast, -0.5 is 50% less")
+	flags.Float64Var(&preprocess.Gamma, "gamma", 1.0, "Gamma correction; values above 1 brighten midtones")
 
-	rootCmd.Flags().StringVarP(&outputDir, "directory", "d", defaultSaveDir, "Path to save the output image. Default: ~/asciify")
-	rootCmd.Flags().StringVarP(&outputFile, "file", "f", "output.png", "Name of the .png output file")
-	rootCmd.Flags().IntVarP(&scaleFactor, "scale", "s", 8, "Scale factor for resizing")
-	rootCmd.Flags().IntVarP(&bloomThreshold, "thresh", "t", 235, "Threshold for which pixel values are considered bright enough to bloom (emit light)")
+	flags.BoolVar(&terminal, "terminal", false, "Also print the result to the terminal using truecolor escape codes")
 
 	// Flags for effects
-	rootCmd.Flags().BoolVarP(&burn, "burn", "r", false, "Color burn the resulting ASCII image")
-	rootCmd.Flags().BoolVarP(&monochrome, "monochrome", "m", false, "Use monochrome ASCII. If disabled, the ASCII output will be colored to the original image.")
-	rootCmd.Flags().BoolVar(&crt, "crt", false, "Apply CRT effect")
-	rootCmd.Flags().BoolVarP(&bloom, "bloom", "b", false, "Apply bloom effect")
+	flags.BoolVarP(&burn, "burn", "r", false, "Color burn the resulting ASCII image")
+	flags.BoolVarP(&monochrome, "monochrome", "m", false, "Use monochrome ASCII. If disabled, the ASCII output will be colored to the original image.")
+	flags.StringVar(&burnMode, "burn-mode", "", "Blend mode --burn blends the image onto itself with: normal, multiply, screen, overlay, soft-light, color-burn, color-dodge, additive or difference. Default: the classic burn, which brightens every channel by 20%")
+	flags.Float64Var(&burnStrength, "burn-strength", 0.5, "Opacity of the --burn-mode blend, between 0 and 1")
+	flags.BoolVar(&transparent, "transparent", false, "Render onto a transparent background instead of black or the monochrome background color")
+	flags.StringVar(&alphaMode, "alpha", "empty", "How transparent source pixels are treated: empty (no glyphs) or matte (flattened onto the background color)")
+	flags.Float64Var(&alphaThreshold, "alpha-thresh", 0.1, "Source opacity between 0 and 1 below which cells are left empty")
+	flags.StringVar(&cellBackground, "cell-bg", "none", "Per-cell backgrounds: none, darken (darkened, desaturated cell color) or palette (darker shade of the monochrome palette)")
+	flags.Float64Var(&cellBgDarken, "cell-bg-darken", 0.3, "Brightness of cell backgrounds relative to the glyph color, between 0 and 1")
+	flags.Float64Var(&cellBgDesaturate, "cell-bg-desaturate", 0.3, "How much to desaturate cell backgrounds, between 0 and 1")
+	flags.StringVar(&paletteName, "palette", "", "Snap colors to a fixed palette: cga, ega, c64, cpc, gameboy, pico8, a .gpl, .hex, .txt (paint.net) or Lospec .json file, or auto:N to extract N colors from the image")
+	flags.StringVar(&paletteMethod, "palette-method", "kmeans", "How auto:N palettes are extracted: kmeans or median-cut")
+	flags.StringVar(&exportPalette, "export-palette", "", "Write the extracted palette (8 colors unless auto:N is used) to <path>.hex and a <path>.png swatch")
+	flags.StringVar(&paletteDither, "palette-dither", "none", "Dithering used when snapping colors to --palette: none, ordered, floyd-steinberg, atkinson or jarvis")
+	flags.BoolVar(&composite, "composite", false, "Blend the ASCII render over the source image instead of a solid background")
+	flags.Float64Var(&compositeOpacity, "composite-opacity", 1.0, "Opacity of the ASCII layer when compositing, between 0 and 1")
+	flags.StringVar(&compositeBlend, "composite-blend", "screen", "Blend mode of the ASCII layer when compositing")
+	flags.Uint32Var(&compositeBlur, "composite-blur", 0, "Blur radius applied to the source image behind the ASCII layer")
+	flags.Float64Var(&compositeDarken, "composite-darken", 0.5, "How much to darken the source image behind the ASCII layer, between 0 and 1")
+	flags.StringVar(&gradientStops, "gradient", "", "Comma separated hex color stops for a monochrome gradient map, dark to light, e.g. \"#000010,#ff00aa,#ffffaa\", or auto:N to use N colors extracted from the image. Implies --monochrome")
+	flags.IntVar(&shades, "shades", 8, "Number of palette shades in monochrome mode")
+	flags.StringVar(&progression, "progression", "linear", "How palette shades are spread: linear, log, inverse-square or quadratic")
+	flags.BoolVar(&crt, "crt", false, "Apply CRT effect (scanlines and vignette)")
+	flags.BoolVarP(&bloom, "bloom", "b", false, "Apply bloom effect")
+	flags.Uint32Var(&bloomOptions.Radius, "bloom-radius", 6, "Blur radius of the bloom glow")
+	flags.UintSliceVar(&bloomRadii, "bloom-radii", nil, "Comma separated blur radii for the multi-scale glyph bloom. Default: radius, 2x radius, 4x radius")
+	flags.Float64Var(&bloomOptions.Intensity, "bloom-intensity", 5, "Strength of the bloom glow. Default: 5 for source bloom, 1 for glyph bloom")
+	flags.Float64Var(&bloomOptions.Knee, "bloom-knee", 0, "Soften the bloom threshold over this many brightness levels (0-255) below it")
+	flags.StringVar(&bloomTintHex, "bloom-tint", "", "Hex color to tint the bloom glow with")
+	flags.StringVar(&bloomBlend, "bloom-blend", "", "Blend mode used to composite the glow. Default: the classic bloom merge for source bloom, additive for glyph bloom")
+	flags.StringVar(&bloomTarget, "bloom-target", "source", "What blooms: source (colors before glyphs are drawn) or glyphs (the rendered characters glow with a multi-scale additive bloom)")
+	flags.BoolVar(&tiled, "tiled", false, "Render in horizontal bands and stream the PNG to disk, bounding memory use for very large images")
+	flags.IntVar(&tileRows, "tile-rows", 64, "Character rows per band in --tiled mode")
+	flags.StringSliceVar(&stageNames, "stages", nil, "Comma separated pipeline stages to run, in order, replacing the ones picked by the other flags. Available: "+strings.Join(asciify.StageNames(), ", "))
+	flags.DurationVar(&timeout, "timeout", 0, "Give up on the render after this long, e.g. 30s or 2m. Default: no limit")
+	flags.StringVar(&debugDir, "debug-dir", "", "Directory to write intermediate debug images to")
 }
 
 func main() {
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Preset is a named set of flag values, keyed by long flag name.
+type Preset map[string]string
+
+var builtinPresets = map[string]Preset{
+	"retro-amber": {
+		"monochrome":       "true",
+		"base-color":       "ffb000",
+		"background-color": "140a00",
+		"bloom":            "true",
+		"thresh":           "200",
+		"crt":              "true",
+	},
+	"matrix-green": {
+		"monochrome":       "true",
+		"base-color":       "00ff41",
+		"background-color": "000a02",
+		"bloom":            "true",
+		"thresh":           "180",
+	},
+	"newspaper": {
+		"monochrome":       "true",
+		"base-color":       "ece6d6",
+		"background-color": "1b1a17",
+		"bloom":            "false",
+		"burn":             "false",
+		"dither":           "ordered",
+		"luminance":        "perceptual",
+	},
+	"neon": {
+		"bloom":        "true",
+		"bloom-target": "glyphs",
+		"thresh":       "170",
+		"burn":         "true",
+		"burn-mode":    "screen",
+	},
+}
+
+// configFile holds the user's presets. Values may be strings, numbers, booleans or lists:
+//
+//	{"presets": {"poster": {"mode": "quadrant", "bloom": true, "thresh": 210, "bloom-radii": [4, 12]}}}
+type configFile struct {
+	Presets map[string]map[string]any `json:"presets"`
+}
+
+func configPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting user home directory: %v", err)
+	}
+	return filepath.Join(home, ".asciify", "config.json"), nil
+}
+
+// loadPresets returns the built-in presets together with the ones from ~/.asciify/config.json,
+// which replace built-in presets of the same name. A missing config file is not an error.
+func loadPresets() (map[string]Preset, error) {
+	presets := maps.Clone(builtinPresets)
+
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return presets, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+
+	var config configFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	for name, values := range config.Presets {
+		preset := Preset{}
+		for flag, value := range values {
+			s, err := flagValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("preset %q, %s: %w", name, flag, err)
+			}
+			preset[flag] = s
+		}
+		presets[name] = preset
+	}
+	return presets, nil
+}
+
+// flagValue turns a JSON value into what would be typed on the command line.
+func flagValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// applyPreset sets the flags of the named preset, except those given explicitly on the command line.
+func applyPreset(cmd *cobra.Command, name string) error {
+	presets, err := loadPresets()
+	if err != nil {
+		return err
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q, available presets are %s", name, strings.Join(slices.Sorted(maps.Keys(presets)), ", "))
+	}
+
+	flags := cmd.Flags()
+	for _, flag := range slices.Sorted(maps.Keys(preset)) {
+		if flags.Lookup(flag) == nil {
+			return fmt.Errorf("preset %q sets unknown flag --%s", name, flag)
+		}
+		if flags.Changed(flag) {
+			continue
+		}
+		if err := flags.Set(flag, preset[flag]); err != nil {
+			return fmt.Errorf("preset %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// changedFlags returns the values of the flags that have been set, in the form restoreFlags takes.
+func changedFlags(flags *pflag.FlagSet) map[string]string {
+	values := map[string]string{}
+	flags.Visit(func(flag *pflag.Flag) {
+		values[flag.Name] = flagString(flag)
+	})
+	return values
+}
+
+// restoreFlags sets the flags back to values, and every other flag that has been set since back
+// to its default, so a preset can be applied again from a clean slate.
+func restoreFlags(flags *pflag.FlagSet, values map[string]string) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		value, set := values[flag.Name]
+		if !flag.Changed && !set {
+			return
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			var items []string
+			if value != "" {
+				items = strings.Split(value, ",")
+			}
+			slice.Replace(items)
+		} else if set {
+			flag.Value.Set(value)
+		} else {
+			flag.Value.Set(flag.DefValue)
+		}
+		flag.Changed = set
+	})
+}
+
+var presetsCmd = &cobra.Command{
+	Use:   "presets",
+	Short: "List the available presets",
+	Long:  "presets lists the built-in presets and the ones defined in ~/.asciify/config.json, with the flags each of them sets.",
+	Run: func(cmd *cobra.Command, args []string) {
+		presets, err := loadPresets()
+		if err != nil {
+			fmt.Println("Error loading presets:", err)
+			os.Exit(1)
+		}
+		for _, name := range slices.Sorted(maps.Keys(presets)) {
+			preset := presets[name]
+			var flags []string
+			for _, flag := range slices.Sorted(maps.Keys(preset)) {
+				flags = append(flags, fmt.Sprintf("--%s=%s", flag, preset[flag]))
+			}
+			fmt.Printf("%-14s %s\n", name, strings.Join(flags, " "))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(presetsCmd)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	asciify "asciify/cmd"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const progressBarWidth = 30
+
+// progressBar draws render progress on a single terminal line.
+type progressBar struct {
+	w       io.Writer
+	stage   string
+	percent int
+}
+
+// newProgressBar returns a bar drawing to stderr, or nil if stderr isn't a terminal.
+func newProgressBar() *progressBar {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progressBar{w: os.Stderr, percent: -1}
+}
+
+func (b *progressBar) Report(event asciify.ProgressEvent) {
+	percent := min(max(int(event.Percent), 0), 100)
+	// only redraw when something visible changed
+	if percent == b.percent && event.Stage == b.stage {
+		return
+	}
+	b.stage, b.percent = event.Stage, percent
+
+	filled := percent * progressBarWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Fprintf(b.w, "\r[%s] %3d%% %-12s", bar, percent, event.Stage)
+}
+
+// Done ends the progress line so later output starts on a fresh one.
+func (b *progressBar) Done() {
+	if b.percent >= 0 {
+		fmt.Fprintln(b.w)
+	}
+}
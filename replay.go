@@ -0,0 +1,145 @@
+package main
+
+import (
+	"asciify/cmd/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// settingsKey is the PNG text keyword the render settings are stored under.
+const settingsKey = "asciify:settings"
+
+// renderSettings is what a render records about itself in its PNG.
+type renderSettings struct {
+	Version string `json:"version"`
+	Font    string `json:"font"`
+	Ramp    string `json:"ramp"`
+	// Flags holds the value of every flag, defaults included.
+	Flags map[string]string `json:"flags"`
+	// Changed lists the flags that were given explicitly or by a preset. Replay only applies
+	// these, so flags whose defaults depend on other flags keep working.
+	Changed []string `json:"changed"`
+}
+
+// replayIgnored are flags about where and how the output is written rather than what it looks like.
+var replayIgnored = []string{"directory", "file", "debug-dir", "export-palette", "terminal", "timeout", "preset", "recursive", "jobs", "interval", "addr", "max-upload", "max-pixels", "concurrency", "request-timeout", "help", "version"}
+
+// renderMetadata describes the render configured by cmd's flags as PNG text entries.
+func renderMetadata(cmd *cobra.Command, fontPath string) (map[string]string, error) {
+	var ramp strings.Builder
+	for i := 0; i < utils.AsciiRampSize(); i++ {
+		ramp.WriteRune(utils.GetRampCharacter(i))
+	}
+	settings := renderSettings{
+		Version: cmd.Root().Version,
+		Font:    filepath.Base(fontPath),
+		Ramp:    ramp.String(),
+		Flags:   map[string]string{},
+	}
+
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if slices.Contains(replayIgnored, flag.Name) {
+			return
+		}
+		settings.Flags[flag.Name] = flagString(flag)
+		if flag.Changed {
+			settings.Changed = append(settings.Changed, flag.Name)
+		}
+	})
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"Software":  "asciify " + cmd.Root().Version,
+		settingsKey: string(data),
+	}, nil
+}
+
+// flagString formats a flag's value the way it is typed on the command line.
+func flagString(flag *pflag.Flag) string {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		return strings.Join(slice.GetSlice(), ",")
+	}
+	return flag.Value.String()
+}
+
+func readSettings(path string) (renderSettings, error) {
+	var settings renderSettings
+	text, err := utils.ReadPNGText(path)
+	if err != nil {
+		return settings, err
+	}
+	data, ok := text[settingsKey]
+	if !ok {
+		return settings, fmt.Errorf("%s has no asciify settings", path)
+	}
+	if err := json.Unmarshal([]byte(data), &settings); err != nil {
+		return settings, fmt.Errorf("error parsing settings: %w", err)
+	}
+	return settings, nil
+}
+
+var (
+	replayDir  string
+	replayFile string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <output.png> [new-input]",
+	Short: "Render another image with the settings of an earlier render",
+	Long:  "replay reads the settings asciify stored in one of its PNGs and renders new-input with them. Without new-input it prints the settings.",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		settings, err := readSettings(args[0])
+		if err != nil {
+			fmt.Println("Error reading settings:", err)
+			os.Exit(1)
+		}
+
+		if len(args) == 1 {
+			fmt.Printf("version: %s\nfont: %s\nramp: %q\n", settings.Version, settings.Font, settings.Ramp)
+			for _, name := range settings.Changed {
+				fmt.Printf("--%s=%s\n", name, settings.Flags[name])
+			}
+			return
+		}
+
+		if settings.Version != rootCmd.Version {
+			fmt.Printf("Warning: %s was rendered by asciify %s, this is %s; the result may differ.\n", args[0], settings.Version, rootCmd.Version)
+		}
+		flags := rootCmd.Flags()
+		for _, name := range settings.Changed {
+			if flags.Lookup(name) == nil {
+				fmt.Printf("Warning: ignoring unknown flag --%s\n", name)
+				continue
+			}
+			if err := flags.Set(name, settings.Flags[name]); err != nil {
+				fmt.Println("Error applying settings:", err)
+				os.Exit(1)
+			}
+		}
+		if cmd.Flags().Changed("directory") {
+			flags.Set("directory", replayDir)
+		}
+		if cmd.Flags().Changed("file") {
+			flags.Set("file", replayFile)
+		}
+
+		rootCmd.Run(rootCmd, args[1:])
+	},
+}
+
+func init() {
+	replayCmd.Flags().StringVarP(&replayDir, "directory", "d", "", "Path to save the output image. Default: ~/asciify")
+	replayCmd.Flags().StringVarP(&replayFile, "file", "f", "", "Name of the .png output file. Default: the input's name")
+	rootCmd.AddCommand(replayCmd)
+}
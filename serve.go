@@ -0,0 +1,423 @@
+package main
+
+import (
+	asciify "asciify/cmd"
+	"asciify/cmd/utils"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveAddr        = ":8080"
+	serveMaxUpload   = 32
+	serveMaxPixels   = 40_000_000
+	serveConcurrency = 2
+	serveTimeout     = time.Minute
+)
+
+// serveIgnored are render flags about files, the terminal and batches, which requests can't set.
+// Neither can they set serve's own flags.
+var serveIgnored = []string{"directory", "file", "debug-dir", "export-palette", "terminal", "timeout", "recursive", "jobs", "tiled", "tile-rows"}
+
+// serveFormats maps the output formats to their content type.
+var serveFormats = map[string]string{
+	"png":  "image/png",
+	"text": "text/plain; charset=utf-8",
+	"ansi": "text/plain; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+	"svg":  "image/svg+xml",
+}
+
+// renderRequest is a decoded POST /render.
+type renderRequest struct {
+	image  []byte
+	format string
+	// options holds flag values by long flag name
+	options map[string]string
+}
+
+// jsonRenderRequest is the body of a POST /render sent as application/json.
+type jsonRenderRequest struct {
+	// Image is the base64 encoded PNG or JPEG.
+	Image   string         `json:"image"`
+	Format  string         `json:"format"`
+	Options map[string]any `json:"options"`
+}
+
+// requestError is a request the client got wrong, answered with its status code.
+type requestError struct {
+	status int
+	err    error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+
+func badRequest(format string, args ...any) error {
+	return &requestError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+// server renders the images posted to it. Requests start from the flags serve was started with.
+type server struct {
+	cmd *cobra.Command
+	// defaults are the flags given to serve, which requests override
+	defaults map[string]string
+	// pipeline keeps the loaded font and glyph cache between requests
+	pipeline *asciify.Pipeline
+	// slots holds a token for every render in progress
+	slots chan struct{}
+	// the limits are read once at startup, as requests set the flags they come from
+	maxUpload int64
+	maxPixels int
+	timeout   time.Duration
+
+	// mu guards the flags, which every request sets before it parses them into a job
+	mu sync.Mutex
+}
+
+func newServer(cmd *cobra.Command) (*server, error) {
+	s := &server{
+		cmd:       cmd,
+		defaults:  changedFlags(cmd.Flags()),
+		slots:     make(chan struct{}, max(serveConcurrency, 1)),
+		maxUpload: int64(serveMaxUpload) << 20,
+		maxPixels: serveMaxPixels,
+		timeout:   serveTimeout,
+	}
+	job, err := newRenderJob(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if s.pipeline, err = asciify.NewPipeline(job.opts); err != nil {
+		return nil, fmt.Errorf("building pipeline: %w", err)
+	}
+	return s, nil
+}
+
+// requestFlag reports whether requests may set the flag.
+func requestFlag(name string) bool {
+	return renderFlags.Lookup(name) != nil && !slices.Contains(serveIgnored, name)
+}
+
+// job parses the request's options on top of the server's defaults.
+func (s *server) job(options map[string]string) (*renderJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flags := s.cmd.Flags()
+	restoreFlags(flags, s.defaults)
+	for _, name := range slices.Sorted(maps.Keys(options)) {
+		if !requestFlag(name) {
+			return nil, badRequest("unknown option %q", name)
+		}
+		if err := flags.Set(name, options[name]); err != nil {
+			return nil, badRequest("option %s: %v", name, err)
+		}
+	}
+	job, err := newRenderJob(s.cmd)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	// a preset may set flags a request can't
+	changed := changedFlags(flags)
+	for _, name := range slices.Sorted(maps.Keys(changed)) {
+		if !requestFlag(name) && changed[name] != s.defaults[name] {
+			return nil, badRequest("preset %q sets --%s, which can't be used over HTTP", presetName, name)
+		}
+	}
+	return job, nil
+}
+
+// parseRequest reads the image, format and options from a raw image body with the options in
+// the query, a multipart form with an image file, or a JSON body. Form fields and the query both
+// name flags; a form may also carry more options as JSON in an "options" field. Forms up to
+// maxMemory bytes are kept in memory.
+func parseRequest(r *http.Request, maxMemory int64) (*renderRequest, error) {
+	req := &renderRequest{format: "png", options: map[string]string{}}
+	addValues := func(values map[string][]string) {
+		for name, value := range values {
+			if name == "format" {
+				req.format = value[len(value)-1]
+			} else if name != "options" && value[len(value)-1] != "" {
+				req.options[name] = strings.Join(value, ",")
+			}
+		}
+	}
+	addJSON := func(options map[string]any) error {
+		for name, value := range options {
+			s, err := flagValue(value)
+			if err != nil {
+				return badRequest("option %s: %v", name, err)
+			}
+			req.options[name] = s
+		}
+		return nil
+	}
+	addValues(r.URL.Query())
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxMemory); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, err
+			}
+			return nil, badRequest("error parsing form: %v", err)
+		}
+		addValues(r.MultipartForm.Value)
+		if options := r.FormValue("options"); options != "" {
+			var values map[string]any
+			if err := json.Unmarshal([]byte(options), &values); err != nil {
+				return nil, badRequest("error parsing options: %v", err)
+			}
+			if err := addJSON(values); err != nil {
+				return nil, err
+			}
+		}
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			return nil, badRequest("no image: %v", err)
+		}
+		defer file.Close()
+		if req.image, err = io.ReadAll(file); err != nil {
+			return nil, err
+		}
+
+	case "application/json":
+		var body jsonRenderRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, badRequest("error parsing request: %v", err)
+		}
+		if body.Format != "" {
+			req.format = body.Format
+		}
+		if err := addJSON(body.Options); err != nil {
+			return nil, err
+		}
+		var err error
+		if req.image, err = base64.StdEncoding.DecodeString(body.Image); err != nil {
+			return nil, badRequest("error decoding image: %v", err)
+		}
+
+	default:
+		var err error
+		if req.image, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := serveFormats[req.format]; !ok {
+		return nil, badRequest("unknown format %q, use one of %s", req.format, strings.Join(slices.Sorted(maps.Keys(serveFormats)), ", "))
+	}
+	if len(req.image) == 0 {
+		return nil, badRequest("no image")
+	}
+	return req, nil
+}
+
+// decodeImage decodes a PNG or JPEG, checking its size against maxPixels before the pixels are
+// allocated.
+func decodeImage(data []byte, maxPixels int) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, badRequest("error decoding image: %v", err)
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, &requestError{http.StatusRequestEntityTooLarge, fmt.Errorf("image is %dx%d, larger than %d pixels", config.Width, config.Height, maxPixels)}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, badRequest("error decoding image: %v", err)
+	}
+	return img, nil
+}
+
+// render renders the request into w. The timeout covers the wait for a free slot too.
+func (s *server) render(ctx context.Context, w http.ResponseWriter, req *renderRequest) error {
+	job, err := s.job(req.options)
+	if err != nil {
+		return err
+	}
+
+	// decoding happens in the slot too, as it takes as much memory as the render
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		return &requestError{http.StatusServiceUnavailable, errors.New("too many renders in progress, try again later")}
+	}
+	img, err := decodeImage(req.image, s.maxPixels)
+	if err != nil {
+		return err
+	}
+
+	pipeline, err := s.pipeline.WithOptions(job.opts)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+	img = utils.BoundImageToScaleMultiple(img, job.opts.ScaleFactor)
+	if pipeline, err = job.imagePipeline(pipeline, img); err != nil {
+		return err
+	}
+	f, err := pipeline.Run(ctx, img)
+	if ctx.Err() != nil {
+		return &requestError{http.StatusServiceUnavailable, fmt.Errorf("render took longer than %s", s.timeout)}
+	}
+	if err != nil {
+		return err
+	}
+
+	// encode before answering, so a failure can still be reported with a status code
+	var out bytes.Buffer
+	switch {
+	case req.format == "png" && f.Image == nil, req.format != "png" && f.Grid == nil:
+		return badRequest("pipeline %s has nothing to write as %s", strings.Join(pipeline.Stages(), ","), req.format)
+	case req.format == "png":
+		err = utils.EncodePNGWithText(&out, f.Image, job.opts.Metadata)
+	case req.format == "text":
+		err = asciify.WriteText(&out, f.Grid)
+	case req.format == "ansi":
+		err = asciify.WriteANSI(&out, f.Grid)
+	case req.format == "html":
+		err = asciify.WriteHTML(&out, f.Grid, f.Canvas())
+	case req.format == "svg":
+		err = asciify.WriteSVG(&out, f.Grid, job.opts.ScaleFactor, f.Canvas())
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", serveFormats[req.format])
+	_, err = out.WriteTo(w)
+	return err
+}
+
+func (s *server) handleRender(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+
+	req, err := parseRequest(r, s.maxUpload)
+	if err == nil {
+		err = s.render(r.Context(), w, req)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		var reqErr *requestError
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &reqErr) {
+			status = reqErr.status
+		} else if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+			err = fmt.Errorf("request is larger than %d MB", s.maxUpload>>20)
+		}
+		http.Error(w, err.Error(), status)
+		log.Printf("%s %s: %d %v", r.RemoteAddr, r.URL, status, err)
+		return
+	}
+	log.Printf("%s %s: %s in %s", r.RemoteAddr, r.URL, req.format, time.Since(start).Round(time.Millisecond))
+}
+
+var formPage = template.Must(template.New("form").Parse(`<!doctype html>
+<title>asciify</title>
+<style>body{font-family:sans-serif;margin:2em}label{display:block;margin:.4em 0}iframe{width:100%;height:70vh;border:1px solid #ccc}</style>
+<h1>asciify</h1>
+<form method="post" action="/render" enctype="multipart/form-data" target="result">
+<label>Image <input type="file" name="image" accept="image/png,image/jpeg" required></label>
+<label>Format <select name="format">{{range .Formats}}<option>{{.}}</option>{{end}}</select></label>
+<label>Preset <select name="preset"><option value="">none</option>{{range .Presets}}<option>{{.}}</option>{{end}}</select></label>
+<label>Mode <select name="mode"><option value="">default</option>{{range .Modes}}<option>{{.}}</option>{{end}}</select></label>
+<label>Scale <input type="number" name="scale" min="1" max="64" placeholder="8"></label>
+<label><input type="checkbox" name="monochrome" value="true"> Monochrome</label>
+<label><input type="checkbox" name="bloom" value="true"> Bloom</label>
+<label><input type="checkbox" name="crt" value="true"> CRT</label>
+<label>More options as JSON, keyed by flag name<br><textarea name="options" rows="3" cols="60" placeholder='{"dither": "atkinson", "thresh": 200}'></textarea></label>
+<button>Render</button>
+</form>
+<iframe name="result"></iframe>
+`))
+
+func (s *server) handleForm(w http.ResponseWriter, r *http.Request) {
+	presets, err := loadPresets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	formPage.Execute(w, map[string][]string{
+		"Formats": {"png", "text", "ansi", "html", "svg"},
+		"Presets": slices.Sorted(maps.Keys(presets)),
+		"Modes":   {"ascii", "halfblock", "quadrant", "sextant", "braille"},
+	})
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Render images over HTTP",
+	Long: `serve answers POST /render with the posted image rendered as png, text, ansi, html or svg (?format=).
+Options are named like the flags, either in the query, as form fields next to a multipart "image"
+file, or in a JSON body of the form {"image": "<base64>", "format": "svg", "options": {"mode": "braille"}}.
+Render flags given to serve are the defaults every request starts from. GET / shows a form to try settings.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := newServer(cmd)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /{$}", s.handleForm)
+		mux.HandleFunc("POST /render", s.handleRender)
+		srv := &http.Server{Addr: serveAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			<-ctx.Done()
+			// let the renders in progress finish
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), s.timeout)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+
+		fmt.Printf("Listening on %s, press Ctrl+C to stop.\n", serveAddr)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		<-stopped
+		fmt.Println("Server stopped.")
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "Address to listen on")
+	serveCmd.Flags().IntVar(&serveMaxUpload, "max-upload", 32, "Largest request accepted, in MB")
+	serveCmd.Flags().IntVar(&serveMaxPixels, "max-pixels", 40_000_000, "Largest image accepted, in pixels")
+	serveCmd.Flags().IntVar(&serveConcurrency, "concurrency", 2, "Number of images rendered at the same time; further requests wait for a free slot")
+	serveCmd.Flags().DurationVar(&serveTimeout, "request-timeout", time.Minute, "Give up on a request after this long, including the wait for a free slot")
+	rootCmd.AddCommand(serveCmd)
+}
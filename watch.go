@@ -0,0 +1,232 @@
+package main
+
+import (
+	asciify "asciify/cmd"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var watchInterval time.Duration
+
+// fileStamp is what polling compares to tell that a file changed. Missing files have the zero stamp.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+// watcher re-renders images when they or the files the settings come from change.
+type watcher struct {
+	cmd  *cobra.Command
+	args []string
+	// explicit holds the flags given on the command line, which reloading a preset leaves alone
+	explicit map[string]string
+	job      *renderJob
+	// pipeline keeps the loaded font and glyph cache from one render to the next
+	pipeline *asciify.Pipeline
+	// seen is what the last poll found, rendered is what the last render used. A file is only
+	// rendered once it looks the same on two polls in a row, so half-written saves are skipped.
+	seen, rendered map[string]fileStamp
+}
+
+func newWatcher(cmd *cobra.Command, args []string) (*watcher, error) {
+	w := &watcher{
+		cmd:      cmd,
+		args:     args,
+		explicit: changedFlags(cmd.Flags()),
+		seen:     map[string]fileStamp{},
+		rendered: map[string]fileStamp{},
+	}
+	job, err := newRenderJob(cmd)
+	if err != nil {
+		return nil, err
+	}
+	w.job = job
+	if w.pipeline, err = asciify.NewPipeline(job.opts); err != nil {
+		return nil, fmt.Errorf("building pipeline: %w", err)
+	}
+	return w, nil
+}
+
+// inputs expands the arguments again, so images added to a watched directory are picked up.
+// Images inside the output directory are left out, or every render would trigger the next.
+func (w *watcher) inputs() ([]imageInput, error) {
+	expanded, err := expandInputs(w.args, recursive)
+	if err != nil {
+		return nil, err
+	}
+	var inputs []imageInput
+	for _, input := range expanded {
+		if !within(input.path, outputDir) {
+			inputs = append(inputs, input)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("no images found outside the output directory")
+	}
+	return inputs, checkOutputFlags(inputs)
+}
+
+func within(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// settingsFiles are the files besides the images that a render depends on.
+func (w *watcher) settingsFiles() []string {
+	var files []string
+	if presetName != "" {
+		if path, err := configPath(); err == nil {
+			files = append(files, path)
+		}
+	}
+	if info, err := os.Stat(paletteName); paletteName != "" && err == nil && !info.IsDir() {
+		files = append(files, paletteName)
+	}
+	return files
+}
+
+// reload rebuilds the job from the flags given on the command line and the current preset.
+func (w *watcher) reload() error {
+	restoreFlags(w.cmd.Flags(), w.explicit)
+	job, err := newRenderJob(w.cmd)
+	if err != nil {
+		return err
+	}
+	pipeline, err := w.pipeline.WithOptions(job.opts)
+	if err != nil {
+		return fmt.Errorf("building pipeline: %w", err)
+	}
+	w.job, w.pipeline = job, pipeline
+	return nil
+}
+
+// poll renders the images that changed since they were last rendered, or all of them if the
+// settings changed. The first poll renders everything.
+func (w *watcher) poll(ctx context.Context) error {
+	first := len(w.rendered) == 0
+	inputs, err := w.inputs()
+	if err != nil {
+		return err
+	}
+
+	current := map[string]fileStamp{}
+	changed := func(path string) bool {
+		stamp := stampOf(path)
+		current[path] = stamp
+		if first {
+			return true
+		}
+		return stamp == w.seen[path] && stamp != w.rendered[path]
+	}
+
+	settingsChanged := false
+	for _, path := range w.settingsFiles() {
+		if changed(path) {
+			if !first {
+				fmt.Printf("[%s] %s changed\n", time.Now().Format(time.TimeOnly), path)
+				settingsChanged = true
+			}
+			w.rendered[path] = current[path]
+		}
+	}
+	var dirty []imageInput
+	for _, input := range inputs {
+		if changed(input.path) || settingsChanged {
+			dirty = append(dirty, input)
+		}
+	}
+	w.seen = current
+
+	if settingsChanged {
+		if err := w.reload(); err != nil {
+			return fmt.Errorf("%w; keeping the previous settings", err)
+		}
+	}
+	for _, input := range dirty {
+		if !first && !settingsChanged {
+			fmt.Printf("[%s] %s changed\n", time.Now().Format(time.TimeOnly), input.path)
+		}
+		w.rendered[input.path] = current[input.path]
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	return w.job.renderInputs(ctx, w.pipeline, dirty)
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch <file-or-dir>...",
+	Short: "Render images again whenever they or their preset change",
+	Long:  "watch renders the images like asciify does, then keeps polling them, the --palette file and, with --preset, ~/.asciify/config.json, and renders again whenever one of them changes. The font and glyph cache are loaded once and reused. Images inside the output directory are not watched. Stop it with Ctrl+C.",
+	Args:  cobra.MinimumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if watchInterval <= 0 {
+			return fmt.Errorf("--interval must be positive, not %s", watchInterval)
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		w, err := newWatcher(cmd, args)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := w.poll(ctx); err != nil {
+			fmt.Println("Error:", err)
+		}
+		fmt.Printf("Watching for changes every %s, press Ctrl+C to stop.\n", watchInterval)
+
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		// an error that keeps coming back, like a missing file, is only reported once
+		lastErr := ""
+		for {
+			select {
+			case <-ctx.Done():
+				fmt.Println("Stopped watching.")
+				return
+			case <-ticker.C:
+				err := w.poll(ctx)
+				if err != nil && err.Error() != lastErr && ctx.Err() == nil {
+					fmt.Println("Error:", err)
+				}
+				lastErr = ""
+				if err != nil {
+					lastErr = err.Error()
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 500*time.Millisecond, "How often to check the files for changes")
+	rootCmd.AddCommand(watchCmd)
+}